@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// loadConfigFile reads a JSON object from filePath and uses the values as flags. The keys are the names of the
+// flags, e.g. {"listen": "127.0.0.1:8080", "ipv4-address": "10.0.0.1/8"}. Flags given on the command line take
+// precedence over values from the file.
+func loadConfigFile(filePath string) error {
+	file, err := os.Open(filepath.Clean(filePath))
+	if err != nil {
+		return fmt.Errorf("could not read config file: %w", err)
+	}
+	defer file.Close()
+
+	values := map[string]interface{}{}
+	decoder := json.NewDecoder(file)
+	decoder.UseNumber()
+	if err := decoder.Decode(&values); err != nil {
+		return fmt.Errorf("failed to parse config file: %w", err)
+	}
+
+	setOnCommandLine := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		setOnCommandLine[f.Name] = true
+	})
+
+	for name, value := range values {
+		if flag.Lookup(name) == nil {
+			return fmt.Errorf("unknown setting in config file: '%s'", name)
+		}
+		if setOnCommandLine[name] {
+			continue
+		}
+		// Flags that can be given multiple times are stored as a list.
+		list, isList := value.([]interface{})
+		if !isList {
+			list = []interface{}{value}
+		}
+		for _, v := range list {
+			if err := flag.Set(name, fmt.Sprint(v)); err != nil {
+				return fmt.Errorf("invalid value for setting '%s' in config file: %w", name, err)
+			}
+		}
+	}
+	return nil
+}
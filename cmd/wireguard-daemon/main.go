@@ -2,90 +2,302 @@ package main
 
 import (
 	"crypto/tls"
-	"crypto/x509"
+	"errors"
 	"flag"
 	"fmt"
-	"io/ioutil"
 	"log"
+	"net"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/fantostisch/wireguard-daemon/internal/api"
 	"github.com/fantostisch/wireguard-daemon/wgmanager"
 )
 
 var (
-	//nolint
-	tlsCertDir = "."
-	//nolint
-	tlsKeyDir = "."
-
+	configFile  = flag.String("config", "", "JSON file with settings, keys are the names of these flags")
 	initStorage = flag.Bool("init", false, "Create config file.")
-	storageFile = flag.String("storage-file", "./storage.json", "File used for storing data")
+	storageType = flag.String("storage", "file",
+		"Storage of users and configs. 'file': JSON file, 'sqlite': SQLite database")
+	storageFile = flag.String("storage-file", "",
+		"File used for storing data, defaults to ./storage.json, or ./storage.db when using SQLite")
+
+	listen = flag.String("listen", "127.0.0.1:8080", "API listen address")
+
+	tlsCACert = flag.String("tls-ca-cert", "",
+		"CA certificate clients of the API must present a certificate of, enables mutual TLS")
+	tlsCert = flag.String("tls-cert", "", "TLS certificate of the API, required when using mutual TLS")
+	tlsKey  = flag.String("tls-key", "", "TLS private key of the API, required when using mutual TLS")
+
+	credentialsFile = flag.String("credentials-file", "",
+		"File with credentials of API callers, one '<name> <secret> [scopes]' per line. "+
+			"Enables authentication of API requests")
 
-	listen      = flag.String("listen", "127.0.0.1:8080", "API listen address")
 	wgInterface = flag.String("wg-interface", "wg0", "WireGuard network interface name")
+	ipv4Address = flag.String("ipv4-address", "10.0.0.1/8",
+		"IPv4 address of the server in CIDR notation, clients get an address from the same prefix")
+	ipv6Address = flag.String("ipv6-address", "fd00::1/64",
+		"IPv6 address of the server in CIDR notation, clients get an address from the same prefix")
+	pools = poolFlags{}
+
+	disabledUserIPs = flag.String("disabled-user-ips", string(api.KeepIPs),
+		"What to do with the addresses of disabled users. 'keep': keep the addresses, "+
+			"'release': release the addresses so they can be used by other users, "+
+			"the user gets new addresses when enabled again")
+	maxConfigsPerUser = flag.Int("max-configs-per-user", 0,
+		"Maximum amount of configs of a user, can be overridden per user. 0 means unlimited")
+	expiredConfigs = flag.String("expired-configs", string(api.DeleteExpiredConfigs),
+		"What to do with configs of which the expiry time has passed. 'delete': delete the configs, "+
+			"'mark': keep the configs and mark them as expired")
+
+	usageFile = flag.String("usage-file", "",
+		"File used for storing the traffic of configs, defaults to usage.json in the directory of the storage file")
+	usageSampleInterval = flag.Duration("usage-sample-interval", 5*time.Minute,
+		"How often the traffic counters of WireGuard are read for traffic accounting")
+	monthlyQuota = flag.Int64("monthly-quota", 0,
+		"Maximum amount of bytes a user can receive and transmit per month, can be overridden per user. "+
+			"0 means unlimited")
+
+	sessionLogFile = flag.String("session-log", "",
+		"File used for recording sessions of clients, defaults to sessions.jsonl in the directory of the storage file")
+	sessionRetention = flag.Duration("session-retention", 90*24*time.Hour,
+		"How long sessions are kept after they ended, 0 keeps sessions forever")
+
+	reconcileInterval = flag.Duration("reconcile-interval", time.Minute,
+		"How often the peers in WireGuard are compared with storage and corrected, 0 disables reconciliation")
+	unexpectedPeers = flag.String("unexpected-peers", string(api.RemoveUnexpectedPeers),
+		"What to do with peers in WireGuard which do not belong to an active config. 'remove': remove the peers, "+
+			"'report': only log the peers")
+
+	clientEndpoint = flag.String("client-endpoint", "",
+		"Host and port clients connect to, e.g. vpn.example.org:51820. Required for creating client config files")
+	clientDNS        = flag.String("client-dns", "", "Comma separated DNS servers used in client config files")
+	clientAllowedIPs = flag.String("client-allowed-ips", "0.0.0.0/0,::/0",
+		"Comma separated networks clients send through the tunnel")
+	clientPersistentKeepalive = flag.Int("client-persistent-keepalive", 0,
+		"Interval in seconds in which clients send keepalive packets, 0 disables keepalive packets")
 )
 
+// poolFlags contains the values of all -pool flags.
+type poolFlags []string
+
+func (p *poolFlags) String() string {
+	return strings.Join(*p, " ")
+}
+
+func (p *poolFlags) Set(value string) error {
+	*p = append(*p, value)
+	return nil
+}
+
+// getTLSConfig returns nil if mutual TLS is not enabled.
+func getTLSConfig() (*tls.Config, error) {
+	if *tlsCACert == "" && *tlsCert == "" && *tlsKey == "" {
+		return nil, nil
+	}
+	if *tlsCACert == "" || *tlsCert == "" || *tlsKey == "" {
+		return nil, errors.New("a CA certificate, a certificate and a key are required to enable mutual TLS")
+	}
+	reloader, err := newCertificateReloader(*tlsCACert, *tlsCert, *tlsKey)
+	if err != nil {
+		return nil, err
+	}
+	return reloader.TLSConfig(), nil
+}
+
+func parseAddressPools() (map[string]api.AddressPool, error) {
+	defaultPool, err := api.ParseAddressPool(*ipv4Address, *ipv6Address)
+	if err != nil {
+		return nil, err
+	}
+	addressPools := map[string]api.AddressPool{api.DefaultPool: defaultPool}
+
+	for _, pool := range pools {
+		nameAndAddresses := strings.SplitN(pool, "=", 2)
+		if len(nameAndAddresses) != 2 {
+			return nil, fmt.Errorf("pool '%s' is not in the format name=ipv4-address,ipv6-address", pool)
+		}
+		name := nameAndAddresses[0]
+		addresses := strings.Split(nameAndAddresses[1], ",")
+		if len(addresses) != 2 {
+			return nil, fmt.Errorf("pool '%s' is not in the format name=ipv4-address,ipv6-address", pool)
+		}
+		if _, exists := addressPools[name]; exists {
+			return nil, fmt.Errorf("pool '%s' is defined multiple times", name)
+		}
+		addressPool, err := api.ParseAddressPool(addresses[0], addresses[1])
+		if err != nil {
+			return nil, fmt.Errorf("pool '%s': %w", name, err)
+		}
+		addressPools[name] = addressPool
+	}
+	return addressPools, nil
+}
+
+func parseClientConfigTemplate() (api.ClientConfigTemplate, error) {
+	template := api.ClientConfigTemplate{
+		Endpoint:            *clientEndpoint,
+		PersistentKeepalive: *clientPersistentKeepalive,
+	}
+	if *clientEndpoint != "" {
+		if _, _, err := net.SplitHostPort(*clientEndpoint); err != nil {
+			return api.ClientConfigTemplate{}, fmt.Errorf("invalid endpoint '%s': %w", *clientEndpoint, err)
+		}
+	}
+	if *clientPersistentKeepalive < 0 {
+		return api.ClientConfigTemplate{}, errors.New("persistent keepalive interval can not be negative")
+	}
+	if *clientDNS != "" {
+		for _, dns := range strings.Split(*clientDNS, ",") {
+			ip := net.ParseIP(strings.TrimSpace(dns))
+			if ip == nil {
+				return api.ClientConfigTemplate{}, fmt.Errorf("invalid DNS server '%s'", dns)
+			}
+			template.DNS = append(template.DNS, ip)
+		}
+	}
+	for _, allowedIP := range strings.Split(*clientAllowedIPs, ",") {
+		_, ipNet, err := net.ParseCIDR(strings.TrimSpace(allowedIP))
+		if err != nil {
+			return api.ClientConfigTemplate{}, fmt.Errorf("invalid allowed IPs: %w", err)
+		}
+		template.AllowedIPs = append(template.AllowedIPs, *ipNet)
+	}
+	return template, nil
+}
+
+// setStorageFile sets the default storage file of the storage type if no file is given.
+func setStorageFile() error {
+	switch *storageType {
+	case "file":
+		if *storageFile == "" {
+			*storageFile = "./storage.json"
+		}
+	case "sqlite":
+		if *storageFile == "" {
+			*storageFile = "./storage.db"
+		}
+	default:
+		return fmt.Errorf("unknown storage '%s'", *storageType)
+	}
+	return nil
+}
+
+func createStorage() error {
+	if *storageType == "sqlite" {
+		return api.NewSQLiteStorage(*storageFile)
+	}
+	return api.NewFileStorage(*storageFile)
+}
+
+func openStorage() (api.Storage, error) {
+	if *storageType == "sqlite" {
+		return api.OpenSQLiteStorage(*storageFile)
+	}
+	return api.ReadFile(*storageFile)
+}
+
 func main() {
 	flag.Usage = func() {
 		flag.PrintDefaults()
 	}
+	flag.Var(&pools, "pool", "Additional named address pool in the format "+
+		"name=ipv4-address,ipv6-address, e.g. staff=10.1.0.1/16,fd01::1/64. Can be given multiple times")
 	flag.Parse()
 
+	if *configFile != "" {
+		if err := loadConfigFile(*configFile); err != nil {
+			log.Fatal("Error loading config file: ", err)
+		}
+	}
+
+	if err := setStorageFile(); err != nil {
+		log.Fatal("Invalid storage: ", err)
+	}
+
+	addressPools, err := parseAddressPools()
+	if err != nil {
+		log.Fatal("Invalid address pool: ", err)
+	}
+
+	clientConfigTemplate, err := parseClientConfigTemplate()
+	if err != nil {
+		log.Fatal("Invalid client config settings: ", err)
+	}
+
 	wgManager, err := wgmanager.New(*wgInterface)
 	if err != nil {
 		log.Fatal("Error creating WireGuard manager: ", err)
 	}
 
 	if *initStorage {
-		err = api.NewFileStorage(*storageFile)
+		err = createStorage()
 		if err != nil {
 			log.Fatal("Error creating file for storage: ", err)
 		}
 		return
 	}
 
-	storage, err := api.ReadFile(*storageFile)
+	storage, err := openStorage()
 	if err != nil {
 		log.Fatal("Error reading stored data. "+
 			"If you have not created a config file yet, create one using --init. Error: ", err)
 	}
-	server, err := api.NewServer(storage, wgManager, *wgInterface)
-	if server == nil || err != nil {
-		log.Fatal("Error creating server: ", err)
+	if *usageFile == "" {
+		*usageFile = filepath.Join(filepath.Dir(*storageFile), "usage.json")
 	}
-	startErr := server.Start(*listen)
-	if startErr != nil {
-		fmt.Println("Error starting server: ", startErr)
-		return
-	}
-}
-
-//nolint
-func getTlsConfig() *tls.Config {
-	caCertFile := filepath.Join(tlsCertDir, "ca.crt")
-	certFile := filepath.Join(tlsCertDir, "server.crt")
-	keyFile := filepath.Join(tlsKeyDir, "server.key")
-
-	keyPair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	usage, err := api.ReadUsageFile(*usageFile)
 	if err != nil {
-		log.Fatal(err)
+		log.Fatal("Error reading usage: ", err)
 	}
-
-	caCertPem, err := ioutil.ReadFile(caCertFile)
+	if *sessionLogFile == "" {
+		*sessionLogFile = filepath.Join(filepath.Dir(*storageFile), "sessions.jsonl")
+	}
+	sessionLog, err := api.OpenSessionLog(*sessionLogFile, *sessionRetention)
 	if err != nil {
-		log.Fatal(err)
+		log.Fatal("Error opening session log: ", err)
 	}
-
-	trustedCaPool := x509.NewCertPool()
-	if !trustedCaPool.AppendCertsFromPEM(caCertPem) {
+	var linkWatcher api.LinkWatcher
+	if watcher, err := wgmanager.NewLinkWatcher(*wgInterface); err != nil {
+		log.Print("WireGuard is not configured when the interface is recreated: ", err)
+	} else {
+		linkWatcher = watcher
+	}
+	var authenticator *api.Authenticator
+	if *credentialsFile != "" {
+		authenticator, err = api.ReadCredentialsFile(*credentialsFile)
+		if err != nil {
+			log.Fatal("Error loading API credentials: ", err)
+		}
 	}
 
-	return &tls.Config{
-		Certificates: []tls.Certificate{keyPair},
-		MinVersion:   tls.VersionTLS12,
-		ClientAuth:   tls.RequireAndVerifyClientCert,
-		ClientCAs:    trustedCaPool,
-		CipherSuites: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384},
+	server, err := api.NewServer(storage, wgManager, api.Config{
+		WGInterface:          *wgInterface,
+		AddressPools:         addressPools,
+		DisabledUserIPPolicy: api.DisabledUserIPPolicy(*disabledUserIPs),
+		MaxConfigsPerUser:    *maxConfigsPerUser,
+		ExpiredConfigPolicy:  api.ExpiredConfigPolicy(*expiredConfigs),
+		Authenticator:        authenticator,
+		ClientConfigTemplate: clientConfigTemplate,
+		Usage:                usage,
+		UsageSampleInterval:  *usageSampleInterval,
+		MonthlyQuota:         *monthlyQuota,
+		SessionLog:           sessionLog,
+		ReconcileInterval:    *reconcileInterval,
+		UnexpectedPeerPolicy: api.UnexpectedPeerPolicy(*unexpectedPeers),
+		LinkWatcher:          linkWatcher,
+	})
+	if server == nil || err != nil {
+		log.Fatal("Error creating server: ", err)
+	}
+	tlsConfig, err := getTLSConfig()
+	if err != nil {
+		log.Fatal("Error loading TLS certificates: ", err)
+	}
+	startErr := server.Start(*listen, tlsConfig)
+	if startErr != nil {
+		fmt.Println("Error starting server: ", startErr)
+		return
 	}
 }
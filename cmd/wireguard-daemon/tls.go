@@ -0,0 +1,150 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// How often the certificate files are checked for changes.
+const certificateCheckInterval = 10 * time.Second
+
+// certificateReloader creates a TLS configuration which requires clients to present a certificate signed by the CA.
+// The certificates are loaded again when one of the files is modified, so certificates can be renewed without
+// restarting the daemon.
+type certificateReloader struct {
+	caCertFile    string
+	certFile      string
+	keyFile       string
+	checkInterval time.Duration
+
+	mutex     sync.Mutex
+	modTimes  []time.Time
+	lastCheck time.Time
+	keyPair   tls.Certificate
+	caPool    *x509.CertPool
+	// Configuration returned by TLSConfig, used as base of the configuration of every connection so settings added
+	// by the HTTP server, like the supported protocols, are kept.
+	base *tls.Config
+}
+
+func newCertificateReloader(caCertFile string, certFile string, keyFile string) (*certificateReloader, error) {
+	r := &certificateReloader{
+		caCertFile:    caCertFile,
+		certFile:      certFile,
+		keyFile:       keyFile,
+		checkInterval: certificateCheckInterval,
+	}
+	r.base = &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: []string{"h2", "http/1.1"},
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return r.getConfig(), nil
+		},
+		// Used by the HTTP server to check if a certificate is configured.
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return &r.getConfig().Certificates[0], nil
+		},
+	}
+	modTimes, err := r.getModTimes()
+	if err != nil {
+		return nil, err
+	}
+	if err := r.load(modTimes); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *certificateReloader) getModTimes() ([]time.Time, error) {
+	var modTimes []time.Time
+	for _, file := range []string{r.caCertFile, r.certFile, r.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+		modTimes = append(modTimes, info.ModTime())
+	}
+	return modTimes, nil
+}
+
+// load loads the certificates. Mutex should be locked or no other goroutines should have access to r.
+func (r *certificateReloader) load(modTimes []time.Time) error {
+	keyPair, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("could not load certificate and key: %w", err)
+	}
+
+	caCertPem, err := ioutil.ReadFile(filepath.Clean(r.caCertFile))
+	if err != nil {
+		return fmt.Errorf("could not read CA certificate: %w", err)
+	}
+
+	trustedCaPool := x509.NewCertPool()
+	if !trustedCaPool.AppendCertsFromPEM(caCertPem) {
+		return errors.New("no valid certificates found in CA certificate file")
+	}
+
+	r.modTimes = modTimes
+	r.keyPair = keyPair
+	r.caPool = trustedCaPool
+	return nil
+}
+
+// getConfig returns the configuration of a connection. If the files have not been checked for changes in the check
+// interval, the certificates are loaded again if a file has been modified. If loading fails, the previous certificates
+// are used.
+func (r *certificateReloader) getConfig() *tls.Config {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if now := time.Now(); now.Sub(r.lastCheck) >= r.checkInterval {
+		r.lastCheck = now
+		r.reloadIfModified()
+	}
+
+	config := r.base.Clone()
+	config.GetConfigForClient = nil
+	config.GetCertificate = nil
+	config.Certificates = []tls.Certificate{r.keyPair}
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	config.ClientCAs = r.caPool
+	config.CipherSuites = []uint16{
+		tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+		tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	}
+	return config
+}
+
+// reloadIfModified loads the certificates if a file has been modified. Mutex should be locked.
+func (r *certificateReloader) reloadIfModified() {
+	modTimes, err := r.getModTimes()
+	if err != nil {
+		log.Print("Error checking TLS certificates for changes: ", err)
+		return
+	}
+	for i, modTime := range modTimes {
+		if !modTime.Equal(r.modTimes[i]) {
+			if err := r.load(modTimes); err != nil {
+				// Do not try again until a file is modified again, e.g. when the key is written after the certificate.
+				r.modTimes = modTimes
+				log.Print("Error reloading TLS certificates, using previous certificates: ", err)
+			} else {
+				log.Print("Reloaded TLS certificates")
+			}
+			return
+		}
+	}
+}
+
+// TLSConfig returns a configuration to be used by the server.
+func (r *certificateReloader) TLSConfig() *tls.Config {
+	return r.base
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCertificate struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// newTestCertificate creates a certificate signed by parent, or a self-signed CA certificate if parent is nil.
+func newTestCertificate(t *testing.T, serial int64, parent *testCertificate) testCertificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "wireguard-daemon"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	signerCert, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		signerCert, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signerCert, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testCertificate{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+// writeServerCertificate writes the certificate and key, with a modification time which differs from the previous
+// files.
+func writeServerCertificate(t *testing.T, certFile string, keyFile string, cert testCertificate, modTime time.Time) {
+	for file, content := range map[string][]byte{certFile: cert.certPEM, keyFile: cert.keyPEM} {
+		if err := ioutil.WriteFile(file, content, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(file, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCertificateReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	caCertFile := filepath.Join(dir, "ca.crt")
+	certFile := filepath.Join(dir, "server.crt")
+	keyFile := filepath.Join(dir, "server.key")
+
+	ca := newTestCertificate(t, 1, nil)
+	client := newTestCertificate(t, 2, &ca)
+	server1 := newTestCertificate(t, 3, &ca)
+	server2 := newTestCertificate(t, 4, &ca)
+	if err := ioutil.WriteFile(caCertFile, ca.certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Now().Add(-time.Minute)
+	writeServerCertificate(t, certFile, keyFile, server1, modTime)
+
+	reloader, err := newCertificateReloader(caCertFile, certFile, keyFile)
+	if err != nil {
+		t.Fatalf("Error loading certificates: %s", err)
+	}
+	reloader.checkInterval = time.Hour
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpServer := &http.Server{
+		Handler:   http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}),
+		TLSConfig: reloader.TLSConfig(),
+	}
+	go httpServer.ServeTLS(listener, "", "")
+	defer httpServer.Close()
+
+	clientKeyPair, err := tls.X509KeyPair(client.certPEM, client.keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caPool := x509.NewCertPool()
+	caPool.AddCert(ca.cert)
+	connect := func() tls.ConnectionState {
+		conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{
+			Certificates: []tls.Certificate{clientKeyPair},
+			RootCAs:      caPool,
+			NextProtos:   []string{"h2", "http/1.1"},
+		})
+		if err != nil {
+			t.Fatalf("Error connecting: %s", err)
+		}
+		defer conn.Close()
+		return conn.ConnectionState()
+	}
+
+	state := connect()
+	if state.PeerCertificates[0].SerialNumber.Int64() != 3 {
+		t.Errorf("Served certificate %s, expected 3", state.PeerCertificates[0].SerialNumber)
+	}
+	if state.NegotiatedProtocol != "h2" {
+		t.Errorf("Negotiated protocol %q, expected h2", state.NegotiatedProtocol)
+	}
+
+	// Files are not checked again within the interval.
+	writeServerCertificate(t, certFile, keyFile, server2, modTime.Add(time.Second))
+	if serial := connect().PeerCertificates[0].SerialNumber.Int64(); serial != 3 {
+		t.Errorf("Served certificate %d within check interval, expected 3", serial)
+	}
+
+	reloader.mutex.Lock()
+	reloader.checkInterval = 0
+	reloader.mutex.Unlock()
+	state = connect()
+	if state.PeerCertificates[0].SerialNumber.Int64() != 4 {
+		t.Errorf("Served certificate %s after renewal, expected 4", state.PeerCertificates[0].SerialNumber)
+	}
+	if state.NegotiatedProtocol != "h2" {
+		t.Errorf("Negotiated protocol %q after renewal, expected h2", state.NegotiatedProtocol)
+	}
+}
@@ -20,7 +20,21 @@ if [ -z "$listen_port" ]; then
 fi
 echo "ListenPort=$listen_port" | (sudo tee -a "$netdev_file" > /dev/null)
 
-sudo cp ./wg0.network /etc/systemd/network/90-wg0.network
+network_file="/etc/systemd/network/90-wg0.network"
+
+sudo cp ./wg0.network "$network_file"
+
+# Must be equal to the addresses the daemon is started with, see -ipv4-address and -ipv6-address.
+ipv4_address=$2
+if [ -z "$ipv4_address" ]; then
+  ipv4_address=10.0.0.1/8
+fi
+ipv6_address=$3
+if [ -z "$ipv6_address" ]; then
+  ipv6_address=fd00::1/64
+fi
+echo "Address=$ipv4_address" | (sudo tee -a "$network_file" > /dev/null)
+echo "Address=$ipv6_address" | (sudo tee -a "$network_file" > /dev/null)
 
 sudo systemctl enable systemd-networkd
 sudo systemctl restart systemd-networkd
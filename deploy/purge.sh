@@ -9,4 +9,6 @@ set -ex
 sudo rm -f "/etc/systemd/network/90-wg0.network"
 sudo rm -f "/etc/systemd/network/90-wg0.netdev"
 sudo systemctl restart systemd-networkd
-sudo rm -f ../_bin/storage.json
+sudo rm -f ../_bin/storage.json ../_bin/storage.json.bak ../_bin/storage.db
+sudo rm -f ../_bin/usage.json
+sudo rm -f ../_bin/sessions.jsonl
@@ -4,5 +4,7 @@ go 1.14
 
 require (
 	github.com/google/go-cmp v0.5.2
+	github.com/mattn/go-sqlite3 v1.14.6
+	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
 	golang.zx2c4.com/wireguard/wgctrl v0.0.0-20200609130330-bd2cb7843e1b
 )
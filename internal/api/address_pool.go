@@ -0,0 +1,85 @@
+package api
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// DefaultPool is the name of the pool used when no pool is chosen for a config and the user has no default pool.
+const DefaultPool = "default"
+
+// AddressPool contains the addresses of the server and the ranges clients get their addresses from.
+type AddressPool struct {
+	IPv4Addr  net.IP
+	IPv4Range *net.IPNet
+	IPv6Addr  net.IP
+	IPv6Range *net.IPNet
+}
+
+// ParseAddressPool parses the IPv4 and IPv6 address of the server in CIDR notation, e.g. 10.0.0.1/8 and fd00::1/64.
+// Clients get an address from the same prefixes.
+func ParseAddressPool(ipv4Address string, ipv6Address string) (AddressPool, error) {
+	ipv4Addr, ipv4Range, err := net.ParseCIDR(ipv4Address)
+	if err != nil {
+		return AddressPool{}, fmt.Errorf("error parsing IPv4 CIDR notation: %w", err)
+	}
+	if ipv4Addr.To4() == nil {
+		return AddressPool{}, fmt.Errorf("'%s' is not an IPv4 address", ipv4Address)
+	}
+
+	ipv6Addr, ipv6Range, err := net.ParseCIDR(ipv6Address)
+	if err != nil {
+		return AddressPool{}, fmt.Errorf("error parsing IPv6 CIDR notation: %w", err)
+	}
+	if ipv6Addr.To4() != nil {
+		return AddressPool{}, fmt.Errorf("'%s' is not an IPv6 address", ipv6Address)
+	}
+
+	return AddressPool{
+		IPv4Addr:  ipv4Addr,
+		IPv4Range: ipv4Range,
+		IPv6Addr:  ipv6Addr,
+		IPv6Range: ipv6Range,
+	}, nil
+}
+
+func (p AddressPool) String() string {
+	return fmt.Sprintf("%s, %s", cidr(p.IPv4Addr, p.IPv4Range), cidr(p.IPv6Addr, p.IPv6Range))
+}
+
+func (p AddressPool) overlaps(other AddressPool) bool {
+	return ipNetsOverlap(p.IPv4Range, other.IPv4Range) || ipNetsOverlap(p.IPv6Range, other.IPv6Range)
+}
+
+func ipNetsOverlap(a *net.IPNet, b *net.IPNet) bool {
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
+
+func cidr(ip net.IP, ipRange *net.IPNet) string {
+	ones, _ := ipRange.Mask.Size()
+	return fmt.Sprintf("%s/%d", ip, ones)
+}
+
+// checkInterfaceAddresses checks if the addresses of the server in the pool are set on the WireGuard interface with
+// the same prefix length. If the prefixes differ, clients would get addresses the server does not route.
+func (p AddressPool) checkInterfaceAddresses(interfaceAddresses []net.IPNet) error {
+	if err := checkInterfaceAddress(p.IPv4Addr, p.IPv4Range, interfaceAddresses); err != nil {
+		return err
+	}
+	return checkInterfaceAddress(p.IPv6Addr, p.IPv6Range, interfaceAddresses)
+}
+
+func checkInterfaceAddress(ip net.IP, ipRange *net.IPNet, interfaceAddresses []net.IPNet) error {
+	prefixLength, _ := ipRange.Mask.Size()
+	var addresses []string
+	for _, interfaceAddress := range interfaceAddresses {
+		interfacePrefixLength, _ := interfaceAddress.Mask.Size()
+		if interfaceAddress.IP.Equal(ip) && interfacePrefixLength == prefixLength {
+			return nil
+		}
+		addresses = append(addresses, interfaceAddress.String())
+	}
+	return fmt.Errorf("address %s is not set on the WireGuard interface, interface addresses: [%s]",
+		cidr(ip, ipRange), strings.Join(addresses, ", "))
+}
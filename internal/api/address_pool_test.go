@@ -0,0 +1,63 @@
+package api
+
+import (
+	"net"
+	"testing"
+)
+
+func parseIPNets(cidrs ...string) []net.IPNet {
+	var ipNets []net.IPNet
+	for _, c := range cidrs {
+		ip, ipNet, _ := net.ParseCIDR(c)
+		ipNets = append(ipNets, net.IPNet{IP: ip, Mask: ipNet.Mask})
+	}
+	return ipNets
+}
+
+func TestCheckInterfaceAddresses(t *testing.T) {
+	pool, err := ParseAddressPool("10.0.0.1/8", "fd00::1/64")
+	if err != nil {
+		t.Fatalf("Error parsing address pool: %s", err)
+	}
+
+	var tests = []struct {
+		testName           string
+		interfaceAddresses []net.IPNet
+		expError           bool
+	}{
+		{"Matching addresses", parseIPNets("10.0.0.1/8", "fd00::1/64"), false},
+		{"Matching addresses and link local address", parseIPNets("fe80::1/64", "10.0.0.1/8", "fd00::1/64"), false},
+		{"No addresses", nil, true},
+		{"Missing IPv6 address", parseIPNets("10.0.0.1/8"), true},
+		{"Different IPv4 address", parseIPNets("10.0.0.2/8", "fd00::1/64"), true},
+		{"Different IPv4 prefix length", parseIPNets("10.0.0.1/16", "fd00::1/64"), true},
+		{"Different IPv6 prefix length", parseIPNets("10.0.0.1/8", "fd00::1/48"), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			err := pool.checkInterfaceAddresses(tt.interfaceAddresses)
+			if (err != nil) != tt.expError {
+				t.Errorf("Got error: %v, expected error: %v", err, tt.expError)
+			}
+		})
+	}
+}
+
+func TestParseAddressPool(t *testing.T) {
+	var tests = []struct {
+		ipv4Address string
+		ipv6Address string
+		expError    bool
+	}{
+		{"10.0.0.1/8", "fd00::1/64", false},
+		{"10.0.0.1", "fd00::1/64", true},
+		{"fd00::1/64", "fd00::1/64", true},
+		{"10.0.0.1/8", "10.0.0.1/8", true},
+	}
+	for _, tt := range tests {
+		_, err := ParseAddressPool(tt.ipv4Address, tt.ipv6Address)
+		if (err != nil) != tt.expError {
+			t.Errorf("%s, %s: got error: %v, expected error: %v", tt.ipv4Address, tt.ipv6Address, err, tt.expError)
+		}
+	}
+}
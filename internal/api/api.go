@@ -2,7 +2,12 @@ package api
 
 import (
 	"fmt"
+	"math"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
 
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
@@ -10,6 +15,40 @@ import (
 type API struct {
 	UserHandler       UserHandler
 	ConnectionHandler ConnectionHandler
+	// Authenticator checks the credentials of requests, if nil requests are not authenticated.
+	Authenticator *Authenticator
+	// Metrics records the requests, if nil requests are not recorded.
+	Metrics *Metrics
+}
+
+// endpointScopes contains the scope a credential must have to use an endpoint.
+var endpointScopes = map[string]Scope{
+	"configs":                    ScopeRead,
+	"client_connections":         ScopeRead,
+	"config_status":              ScopeRead,
+	"client_config":              ScopeRead,
+	"client_config_qr":           ScopeRead,
+	"usage":                      ScopeRead,
+	"quota":                      ScopeRead,
+	"sessions":                   ScopeRead,
+	"metrics":                    ScopeRead,
+	"create_config":              ScopeConfigs,
+	"create_config_and_key_pair": ScopeConfigs,
+	"delete_config":              ScopeConfigs,
+	"rotate_preshared_key":       ScopeConfigs,
+	"set_config_routing":         ScopeConfigs,
+	"rename_config":              ScopeConfigs,
+	"disable_user":               ScopeUsers,
+	"enable_user":                ScopeUsers,
+	"set_user_pool":              ScopeUsers,
+	"set_config_limit":           ScopeUsers,
+	"set_monthly_quota":          ScopeUsers,
+}
+
+// publicEndpoints can be used without authentication, so they can be used by load balancers and service managers.
+var publicEndpoints = map[string]bool{
+	"healthz": true,
+	"readyz":  true,
 }
 
 func checkContentType(w http.ResponseWriter, req *http.Request) bool {
@@ -67,9 +106,206 @@ func getPublicKey(w http.ResponseWriter, req *http.Request) (PublicKey, bool) {
 	return PublicKey{publicKey}, true
 }
 
+// getAllowedIPs gets the optional comma separated networks in allowed_ips. If the value is invalid an error response
+// will be written and false will be returned.
+func getAllowedIPs(w http.ResponseWriter, req *http.Request) ([]Subnet, bool) {
+	value := req.FormValue("allowed_ips")
+	if value == "" {
+		return nil, true
+	}
+	var allowedIPs []Subnet
+	for _, cidr := range strings.Split(value, ",") {
+		subnet, err := ParseSubnet(strings.TrimSpace(cidr))
+		if err != nil {
+			message := fmt.Sprintf("Invalid allowed IPs: '%s'. %s", value, err)
+			replyWithError(w, InvalidAllowedIPs, message)
+			return nil, false
+		}
+		allowedIPs = append(allowedIPs, subnet)
+	}
+	return allowedIPs, true
+}
+
+// getPersistentKeepalive gets the optional keepalive interval in seconds in persistent_keepalive. If the value is
+// invalid an error response will be written and false will be returned.
+func getPersistentKeepalive(w http.ResponseWriter, req *http.Request) (int, bool) {
+	value := req.FormValue("persistent_keepalive")
+	if value == "" {
+		return 0, true
+	}
+	persistentKeepalive, err := strconv.Atoi(value)
+	if err != nil || persistentKeepalive < 0 || persistentKeepalive > math.MaxUint16 {
+		message := fmt.Sprintf("Invalid persistent keepalive: '%s'. Must be a number of seconds between 0 and %d.",
+			value, math.MaxUint16)
+		replyWithError(w, InvalidKeepalive, message)
+		return 0, false
+	}
+	return persistentKeepalive, true
+}
+
+// getExpires gets the optional expiry time of a config in RFC 3339 format in expires. If the value is invalid or not
+// in the future an error response will be written and false will be returned.
+func getExpires(w http.ResponseWriter, req *http.Request) (*TimeJ, bool) {
+	value := req.FormValue("expires")
+	if value == "" {
+		return nil, true
+	}
+	expires, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		message := fmt.Sprintf("Invalid expiry time: '%s'. Must be in RFC 3339 format. %s", value, err)
+		replyWithError(w, InvalidExpiry, message)
+		return nil, false
+	}
+	if !expires.After(time.Now()) {
+		message := fmt.Sprintf("Invalid expiry time: '%s'. Must be in the future.", value)
+		replyWithError(w, InvalidExpiry, message)
+		return nil, false
+	}
+	return &TimeJ{expires.UTC()}, true
+}
+
+const maxNameLength = 64
+const maxMetadataEntries = 16
+const maxMetadataLength = 255
+
+// getName gets the optional name of a config in name. If the name is too long an error response will be written and
+// false will be returned.
+func getName(w http.ResponseWriter, req *http.Request) (string, bool) {
+	name := req.FormValue("name")
+	if utf8.RuneCountInString(name) > maxNameLength {
+		message := fmt.Sprintf("Invalid name: '%s'. Can not be longer than %d characters.", name, maxNameLength)
+		replyWithError(w, InvalidName, message)
+		return "", false
+	}
+	return name, true
+}
+
+// getMetadata gets the optional metadata of a config from parameters in the format metadata[key]=value. If the
+// metadata is invalid an error response will be written and false will be returned.
+func getMetadata(w http.ResponseWriter, req *http.Request) (map[string]string, bool) {
+	// Make sure the form is parsed.
+	req.FormValue("metadata")
+
+	var metadata map[string]string
+	for parameter, values := range req.Form {
+		if !strings.HasPrefix(parameter, "metadata[") || !strings.HasSuffix(parameter, "]") {
+			continue
+		}
+		key := strings.TrimSuffix(strings.TrimPrefix(parameter, "metadata["), "]")
+		value := values[0]
+		if key == "" || len(key) > maxMetadataLength || len(value) > maxMetadataLength {
+			message := fmt.Sprintf("Invalid metadata: '%s'. Keys can not be empty and keys and values can not be "+
+				"longer than %d bytes.", parameter, maxMetadataLength)
+			replyWithError(w, InvalidMetadata, message)
+			return nil, false
+		}
+		if metadata == nil {
+			metadata = map[string]string{}
+		}
+		metadata[key] = value
+	}
+	if len(metadata) > maxMetadataEntries {
+		message := fmt.Sprintf("Invalid metadata: a config can not have more than %d entries.", maxMetadataEntries)
+		replyWithError(w, InvalidMetadata, message)
+		return nil, false
+	}
+	return metadata, true
+}
+
+// getTime gets an optional time in RFC 3339 format, the zero time is returned if the value is missing. If the value is
+// invalid an error response will be written and false will be returned.
+func getTime(w http.ResponseWriter, req *http.Request, key string) (time.Time, bool) {
+	value := req.FormValue(key)
+	if value == "" {
+		return time.Time{}, true
+	}
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		replyWithError(w, InvalidTimeRange, fmt.Sprintf("Invalid time '%s' in %s: %s", value, key, err))
+		return time.Time{}, false
+	}
+	return parsed, true
+}
+
+// getTimeRange gets the optional times in from and to, a missing time is the zero time and leaves the range unbounded
+// on that side.
+func getTimeRange(w http.ResponseWriter, req *http.Request) (time.Time, time.Time, bool) {
+	from, e := getTime(w, req, "from")
+	if !e {
+		return time.Time{}, time.Time{}, false
+	}
+	to, e := getTime(w, req, "to")
+	if !e {
+		return time.Time{}, time.Time{}, false
+	}
+	if !to.IsZero() && from.After(to) {
+		replyWithError(w, InvalidTimeRange, "The time in from is after the time in to.")
+		return time.Time{}, time.Time{}, false
+	}
+	return from, to, true
+}
+
+func getCreateConfigOptions(w http.ResponseWriter, req *http.Request) (createConfigOptions, bool) {
+	allowedIPs, e := getAllowedIPs(w, req)
+	if !e {
+		return createConfigOptions{}, false
+	}
+	persistentKeepalive, e := getPersistentKeepalive(w, req)
+	if !e {
+		return createConfigOptions{}, false
+	}
+	expires, e := getExpires(w, req)
+	if !e {
+		return createConfigOptions{}, false
+	}
+	name, e := getName(w, req)
+	if !e {
+		return createConfigOptions{}, false
+	}
+	metadata, e := getMetadata(w, req)
+	if !e {
+		return createConfigOptions{}, false
+	}
+	return createConfigOptions{
+		pool:                req.FormValue("pool"),
+		includeClientConfig: req.FormValue("client_config") == "true",
+		presharedKey:        req.FormValue("preshared_key") == "true",
+		allowedIPs:          allowedIPs,
+		persistentKeepalive: persistentKeepalive,
+		expires:             expires,
+		name:                name,
+		metadata:            metadata,
+	}, true
+}
+
 // nolint: gocyclo
 func (h API) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	URL := req.URL.EscapedPath()[1:] // remove leading '/'
+	if h.Metrics != nil {
+		recorder := &statusRecorder{ResponseWriter: w, statusCode: http.StatusOK}
+		w = recorder
+		start := time.Now()
+		defer func() {
+			h.Metrics.observeRequest(URL, recorder.statusCode, time.Since(start))
+		}()
+	}
+	if h.Authenticator != nil && !publicEndpoints[URL] {
+		credential, err := h.Authenticator.authenticate(req)
+		if err != nil {
+			replyUnauthorized(w, err)
+			return
+		}
+		scope, exists := endpointScopes[URL]
+		if !exists {
+			http.NotFound(w, req)
+			return
+		}
+		if !credential.hasScope(scope) {
+			replyForbidden(w, credential, scope)
+			return
+		}
+	}
+
 	switch URL {
 	case "configs":
 		username, e := getUserID(w, req)
@@ -94,7 +330,11 @@ func (h API) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 			if !e {
 				return
 			}
-			h.UserHandler.createConfig(w, username, publicKey)
+			options, e := getCreateConfigOptions(w, req)
+			if !e {
+				return
+			}
+			h.UserHandler.createConfig(w, username, publicKey, options)
 
 		default:
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -108,11 +348,110 @@ func (h API) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		}
 		switch req.Method {
 		case http.MethodPost:
-			h.UserHandler.createConfigGenerateKeyPair(w, username)
+			options, e := getCreateConfigOptions(w, req)
+			if !e {
+				return
+			}
+			h.UserHandler.createConfigGenerateKeyPair(w, username, options)
 		default:
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
+	case "client_config":
+		switch req.Method {
+		case http.MethodPost:
+			username, e := getUserID(w, req)
+			if !e {
+				return
+			}
+			publicKey, e := getPublicKey(w, req)
+			if !e {
+				return
+			}
+			h.UserHandler.getClientConfig(w, username, publicKey, req.FormValue("private_key"))
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	case "client_config_qr":
+		switch req.Method {
+		case http.MethodPost:
+			username, e := getUserID(w, req)
+			if !e {
+				return
+			}
+			publicKey, e := getPublicKey(w, req)
+			if !e {
+				return
+			}
+			privateKey := getRequiredPOSTValue(w, req, "private_key")
+			if privateKey == "" {
+				return
+			}
+			format := QRCodeFormat(req.FormValue("format"))
+			if format == "" {
+				format = QRCodePNG
+			}
+			h.UserHandler.getClientConfigQRCode(w, username, publicKey, privateKey, format)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	case "rotate_preshared_key":
+		switch req.Method {
+		case http.MethodPost:
+			username, e := getUserID(w, req)
+			if !e {
+				return
+			}
+			publicKey, e := getPublicKey(w, req)
+			if !e {
+				return
+			}
+			h.UserHandler.rotatePresharedKey(w, username, publicKey)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	case "set_config_routing":
+		switch req.Method {
+		case http.MethodPost:
+			username, e := getUserID(w, req)
+			if !e {
+				return
+			}
+			publicKey, e := getPublicKey(w, req)
+			if !e {
+				return
+			}
+			allowedIPs, e := getAllowedIPs(w, req)
+			if !e {
+				return
+			}
+			persistentKeepalive, e := getPersistentKeepalive(w, req)
+			if !e {
+				return
+			}
+			h.UserHandler.setConfigRouting(w, username, publicKey, allowedIPs, persistentKeepalive)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	case "rename_config":
+		switch req.Method {
+		case http.MethodPost:
+			username, e := getUserID(w, req)
+			if !e {
+				return
+			}
+			publicKey, e := getPublicKey(w, req)
+			if !e {
+				return
+			}
+			name, e := getName(w, req)
+			if !e {
+				return
+			}
+			h.UserHandler.renameConfig(w, username, publicKey, name)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
 	case "delete_config":
 		switch req.Method {
 		case http.MethodPost:
@@ -150,6 +489,140 @@ func (h API) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		default:
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		}
+	case "set_user_pool":
+		switch req.Method {
+		case http.MethodPost:
+			username, e := getUserID(w, req)
+			if !e {
+				return
+			}
+			pool := getRequiredPOSTValue(w, req, "pool")
+			if pool == "" {
+				return
+			}
+			h.UserHandler.setUserPool(w, username, pool)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	case "set_config_limit":
+		switch req.Method {
+		case http.MethodPost:
+			username, e := getUserID(w, req)
+			if !e {
+				return
+			}
+			limit := getRequiredPOSTValue(w, req, "limit")
+			if limit == "" {
+				return
+			}
+			h.UserHandler.setConfigLimit(w, username, limit)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	case "set_monthly_quota":
+		switch req.Method {
+		case http.MethodPost:
+			username, e := getUserID(w, req)
+			if !e {
+				return
+			}
+			quota := getRequiredPOSTValue(w, req, "quota")
+			if quota == "" {
+				return
+			}
+			h.UserHandler.setMonthlyQuota(w, username, quota)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	case "quota":
+		switch req.Method {
+		case http.MethodGet:
+			username, e := getUserID(w, req)
+			if !e {
+				return
+			}
+			h.UserHandler.getQuotaStatus(w, username)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	case "sessions":
+		switch req.Method {
+		case http.MethodGet:
+			username, e := getUserID(w, req)
+			if !e {
+				return
+			}
+			var publicKey *PublicKey
+			if req.FormValue("public_key") != "" {
+				configPublicKey, e := getPublicKey(w, req)
+				if !e {
+					return
+				}
+				publicKey = &configPublicKey
+			}
+			from, to, e := getTimeRange(w, req)
+			if !e {
+				return
+			}
+			h.UserHandler.getSessions(w, username, publicKey, from, to)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	case "config_status":
+		switch req.Method {
+		case http.MethodGet:
+			username, e := getUserID(w, req)
+			if !e {
+				return
+			}
+			publicKey, e := getPublicKey(w, req)
+			if !e {
+				return
+			}
+			h.ConnectionHandler.getConfigStatus(w, username, publicKey)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	case "usage":
+		switch req.Method {
+		case http.MethodGet:
+			username, e := getUserID(w, req)
+			if !e {
+				return
+			}
+			if req.FormValue("public_key") == "" {
+				h.UserHandler.getUserUsage(w, username)
+				return
+			}
+			publicKey, e := getPublicKey(w, req)
+			if !e {
+				return
+			}
+			h.UserHandler.getConfigUsage(w, username, publicKey)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	case "metrics":
+		switch req.Method {
+		case http.MethodGet:
+			h.UserHandler.getMetrics(w)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	case "healthz":
+		switch req.Method {
+		case http.MethodGet:
+			h.UserHandler.getHealth(w)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	case "readyz":
+		switch req.Method {
+		case http.MethodGet:
+			h.UserHandler.getReadiness(w)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
 	case "client_connections":
 		switch req.Method {
 		case http.MethodGet:
@@ -0,0 +1,256 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Credential is a secret an API caller authenticates with.
+type Credential struct {
+	Name   string
+	Secret string
+	// Scopes the caller has access to, nil means access to all scopes.
+	Scopes []Scope
+}
+
+// Scope is a group of API endpoints a credential can be given access to.
+type Scope string
+
+const (
+	// ScopeRead gives access to configs and connections of users.
+	ScopeRead Scope = "read"
+	// ScopeConfigs gives access to creating and deleting configs.
+	ScopeConfigs Scope = "configs"
+	// ScopeUsers gives access to enabling and disabling users and changing the settings of users.
+	ScopeUsers Scope = "users"
+)
+
+var allScopes = []Scope{ScopeRead, ScopeConfigs, ScopeUsers}
+
+func (c Credential) hasScope(scope Scope) bool {
+	if c.Scopes == nil {
+		return true
+	}
+	for _, s := range c.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func parseScopes(value string) ([]Scope, error) {
+	scopes := []Scope{}
+	for _, name := range strings.Split(value, ",") {
+		scope := Scope(name)
+		known := false
+		for _, s := range allScopes {
+			if s == scope {
+				known = true
+			}
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown scope '%s'", name)
+		}
+		scopes = append(scopes, scope)
+	}
+	return scopes, nil
+}
+
+// Authenticator checks if requests are sent by a known API caller. A caller either sends its secret as bearer token
+// using the header "Authorization: Bearer <secret>" or signs the request using HMAC-SHA256 with its secret as key
+// using the header "Authorization: HMAC-SHA256 <name>:<unix timestamp>:<hex encoded signature>". The signature is
+// calculated over "<method>\n<request URI>\n<unix timestamp>\n<body>". Signed requests are only accepted once and
+// only if the timestamp differs less than maxClockSkew from the time of the server.
+type Authenticator struct {
+	credentials []Credential
+	now         func() time.Time
+
+	mutex sync.Mutex
+	// Signatures of accepted requests and when they expire.
+	usedSignatures map[string]time.Time
+}
+
+const maxClockSkew = 5 * time.Minute
+const maxSignedBodySize = 1 << 20
+
+var errInvalidCredentials = errors.New("invalid credentials")
+
+func NewAuthenticator(credentials []Credential) *Authenticator {
+	return &Authenticator{
+		credentials:    credentials,
+		now:            time.Now,
+		usedSignatures: map[string]time.Time{},
+	}
+}
+
+// ReadCredentialsFile reads credentials from a file. Every line contains the name of a credential, the secret and
+// optionally a comma separated list of scopes, separated by whitespace. A credential without scopes has access to all
+// scopes. Empty lines and lines starting with # are ignored.
+func ReadCredentialsFile(filePath string) (*Authenticator, error) {
+	file, err := os.Open(filepath.Clean(filePath))
+	if err != nil {
+		return nil, fmt.Errorf("could not read credentials file: %w", err)
+	}
+	defer file.Close()
+
+	credentials, err := parseCredentials(file)
+	if err != nil {
+		return nil, err
+	}
+	return NewAuthenticator(credentials), nil
+}
+
+func parseCredentials(reader io.Reader) ([]Credential, error) {
+	var credentials []Credential
+	names := map[string]bool{}
+	scanner := bufio.NewScanner(reader)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		const maxFields = 3
+		if len(fields) < 2 || len(fields) > maxFields {
+			return nil, fmt.Errorf("line %d: expected a name, a secret and optionally scopes", lineNumber)
+		}
+		if names[fields[0]] {
+			return nil, fmt.Errorf("line %d: credential '%s' is defined multiple times", lineNumber, fields[0])
+		}
+		names[fields[0]] = true
+		credential := Credential{Name: fields[0], Secret: fields[1]}
+		if len(fields) == maxFields {
+			scopes, err := parseScopes(fields[2])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+			}
+			credential.Scopes = scopes
+		}
+		credentials = append(credentials, credential)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("could not read credentials: %w", err)
+	}
+	return credentials, nil
+}
+
+// authenticate returns the credential the request was authenticated with.
+func (a *Authenticator) authenticate(req *http.Request) (*Credential, error) {
+	authorization := req.Header.Get("Authorization")
+	switch {
+	case authorization == "":
+		return nil, errors.New("no credentials supplied")
+	case strings.HasPrefix(authorization, "Bearer "):
+		return a.authenticateBearer(strings.TrimPrefix(authorization, "Bearer "))
+	case strings.HasPrefix(authorization, "HMAC-SHA256 "):
+		return a.authenticateHMAC(req, strings.TrimPrefix(authorization, "HMAC-SHA256 "))
+	default:
+		return nil, errors.New("unsupported authorization scheme")
+	}
+}
+
+func (a *Authenticator) authenticateBearer(token string) (*Credential, error) {
+	var found *Credential
+	// Compare with every secret so the time taken does not depend on which credential matches.
+	for i := range a.credentials {
+		if subtle.ConstantTimeCompare([]byte(a.credentials[i].Secret), []byte(token)) == 1 {
+			found = &a.credentials[i]
+		}
+	}
+	if found == nil {
+		return nil, errInvalidCredentials
+	}
+	return found, nil
+}
+
+func (a *Authenticator) authenticateHMAC(req *http.Request, parameters string) (*Credential, error) {
+	parts := strings.Split(parameters, ":")
+	const amountOfParts = 3
+	if len(parts) != amountOfParts {
+		return nil, errors.New("expected HMAC-SHA256 <name>:<timestamp>:<signature>")
+	}
+	name, timestampString, signatureString := parts[0], parts[1], parts[2]
+
+	var credential *Credential
+	for i := range a.credentials {
+		if a.credentials[i].Name == name {
+			credential = &a.credentials[i]
+		}
+	}
+	if credential == nil {
+		return nil, errInvalidCredentials
+	}
+
+	unixTimestamp, err := strconv.ParseInt(timestampString, 10, 64)
+	if err != nil {
+		return nil, errors.New("invalid timestamp")
+	}
+	timestamp := time.Unix(unixTimestamp, 0)
+	now := a.now()
+	if timestamp.Before(now.Add(-maxClockSkew)) || timestamp.After(now.Add(maxClockSkew)) {
+		return nil, errors.New("timestamp too far from the time of the server")
+	}
+
+	signature, err := hex.DecodeString(signatureString)
+	if err != nil {
+		return nil, errors.New("invalid signature encoding")
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, maxSignedBodySize))
+	if err != nil {
+		return nil, fmt.Errorf("could not read body: %w", err)
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	if !hmac.Equal(signature, signRequest(credential.Secret, req.Method, req.RequestURI, timestampString, body)) {
+		return nil, errInvalidCredentials
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	for usedSignature, expires := range a.usedSignatures {
+		if now.After(expires) {
+			delete(a.usedSignatures, usedSignature)
+		}
+	}
+	// Use the decoded signature, the same signature can be encoded using both upper and lower case letters.
+	if _, used := a.usedSignatures[string(signature)]; used {
+		return nil, errors.New("request has already been received")
+	}
+	a.usedSignatures[string(signature)] = timestamp.Add(maxClockSkew)
+
+	return credential, nil
+}
+
+func signRequest(secret string, method string, requestURI string, timestamp string, body []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(method + "\n" + requestURI + "\n" + timestamp + "\n"))
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+func replyUnauthorized(w http.ResponseWriter, err error) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="wireguard-daemon"`)
+	replyWithErrorStatus(w, http.StatusUnauthorized, Unauthorized, fmt.Sprintf("Authentication failed: %s", err))
+}
+
+func replyForbidden(w http.ResponseWriter, credential *Credential, scope Scope) {
+	message := fmt.Sprintf("Credential '%s' does not have scope '%s'.", credential.Name, scope)
+	replyWithErrorStatus(w, http.StatusForbidden, Forbidden, message)
+}
@@ -0,0 +1,191 @@
+package api
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+const portalSecret = "portal-secret"
+const monitoringSecret = "monitoring-secret"
+
+var authTime = time.Date(2020, 10, 13, 17, 52, 14, 0, time.UTC)
+
+func newAuthRouter() API {
+	authenticator := NewAuthenticator([]Credential{
+		{Name: "monitoring", Secret: monitoringSecret, Scopes: []Scope{ScopeRead}},
+		{Name: "portal", Secret: portalSecret},
+	})
+	authenticator.now = func() time.Time { return authTime }
+	return API{
+		UserHandler:       UserHandler{Server: server},
+		ConnectionHandler: ConnectionHandler{wgManager: server.wgManager, storage: server.Storage},
+		Authenticator:     authenticator,
+	}
+}
+
+func newDisableUserRequest(username string) *http.Request {
+	body := url.Values{"user_id": {username}}.Encode()
+	req := httptest.NewRequest(http.MethodPost, "/disable_user", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return req
+}
+
+func signedDisableUserRequest(username string, credential string, secret string, timestamp time.Time) *http.Request {
+	req := newDisableUserRequest(username)
+	unixTimestamp := fmt.Sprint(timestamp.Unix())
+	body := url.Values{"user_id": {username}}.Encode()
+	signature := signRequest(secret, req.Method, req.RequestURI, unixTimestamp, []byte(body))
+	req.Header.Set("Authorization",
+		fmt.Sprintf("HMAC-SHA256 %s:%s:%s", credential, unixTimestamp, hex.EncodeToString(signature)))
+	return req
+}
+
+func testAuthenticated(t *testing.T, router API, req *http.Request, authenticated bool) {
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if !authenticated {
+		testHTTPStatus(t, *rr, http.StatusUnauthorized)
+		got := JSONError{}
+		if err := json.NewDecoder(rr.Body).Decode(&got); err != nil {
+			t.Errorf("Error decoding json: %s", err)
+		}
+		if got.ErrorType != Unauthorized.Type {
+			t.Errorf("Got error type: %s, Wanted: %s", got.ErrorType, Unauthorized.Type)
+		}
+		return
+	}
+	if rr.Code == http.StatusUnauthorized {
+		t.Errorf("Request was not authenticated: %s", rr.Body)
+	}
+}
+
+func TestBearerAuthentication(t *testing.T) {
+	setup()
+	router := newAuthRouter()
+
+	testAuthenticated(t, router, newDisableUserRequest(peterUsername), false)
+
+	req := newDisableUserRequest(peterUsername)
+	req.Header.Set("Authorization", "Bearer wrong-secret")
+	testAuthenticated(t, router, req, false)
+
+	req = newDisableUserRequest(peterUsername)
+	req.Header.Set("Authorization", "Basic "+portalSecret)
+	testAuthenticated(t, router, req, false)
+
+	req = newDisableUserRequest(peterUsername)
+	req.Header.Set("Authorization", "Bearer "+portalSecret)
+	testAuthenticated(t, router, req, true)
+	if !server.Storage.IsDisabled(peterUsername) {
+		t.Errorf("User was not disabled.")
+	}
+}
+
+func TestHMACAuthentication(t *testing.T) {
+	setup()
+	router := newAuthRouter()
+
+	testAuthenticated(t, router, signedDisableUserRequest(peterUsername, "portal", "wrong-secret", authTime), false)
+	testAuthenticated(t, router, signedDisableUserRequest(peterUsername, "unknown", portalSecret, authTime), false)
+
+	tooOld := authTime.Add(-maxClockSkew - time.Second)
+	testAuthenticated(t, router, signedDisableUserRequest(peterUsername, "portal", portalSecret, tooOld), false)
+	tooNew := authTime.Add(maxClockSkew + time.Second)
+	testAuthenticated(t, router, signedDisableUserRequest(peterUsername, "portal", portalSecret, tooNew), false)
+
+	tampered := signedDisableUserRequest(peterUsername, "portal", portalSecret, authTime)
+	tampered.Body = newDisableUserRequest("Nick").Body
+	testAuthenticated(t, router, tampered, false)
+
+	testAuthenticated(t, router, signedDisableUserRequest(peterUsername, "portal", portalSecret, authTime), true)
+	if !server.Storage.IsDisabled(peterUsername) {
+		t.Errorf("User was not disabled, body was not available after checking the signature.")
+	}
+
+	// Replaying the same request must fail, also when the signature is encoded in upper case.
+	testAuthenticated(t, router, signedDisableUserRequest(peterUsername, "portal", portalSecret, authTime), false)
+	replayed := signedDisableUserRequest(peterUsername, "portal", portalSecret, authTime)
+	authorization := replayed.Header.Get("Authorization")
+	signatureStart := strings.LastIndex(authorization, ":") + 1
+	replayed.Header.Set("Authorization", authorization[:signatureStart]+strings.ToUpper(authorization[signatureStart:]))
+	testAuthenticated(t, router, replayed, false)
+}
+
+func TestParseCredentials(t *testing.T) {
+	credentials, err := parseCredentials(
+		strings.NewReader("# comment\n\nportal s3cret\n  monitoring\tother  read\nlimited x read,users\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := []Credential{
+		{Name: "portal", Secret: "s3cret"},
+		{Name: "monitoring", Secret: "other", Scopes: []Scope{ScopeRead}},
+		{Name: "limited", Secret: "x", Scopes: []Scope{ScopeRead, ScopeUsers}},
+	}
+	if diff := cmp.Diff(exp, credentials); diff != "" {
+		t.Errorf("Credentials differ (-want +got):\n%s", diff)
+	}
+
+	for _, invalid := range []string{"portal", "portal s3cret read extra", "portal a\nportal b", "portal s3cret admin",
+		"portal s3cret read,"} {
+		if _, err := parseCredentials(strings.NewReader(invalid)); err == nil {
+			t.Errorf("No error for invalid credentials: %q", invalid)
+		}
+	}
+}
+
+func TestScopes(t *testing.T) {
+	setup()
+	router := newAuthRouter()
+
+	req := httptest.NewRequest(http.MethodGet, "/configs?user_id="+url.QueryEscape(peterUsername), nil)
+	req.Header.Set("Authorization", "Bearer "+monitoringSecret)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	testHTTPStatus(t, *rr, http.StatusOK)
+
+	req = newDisableUserRequest(peterUsername)
+	req.Header.Set("Authorization", "Bearer "+monitoringSecret)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	testHTTPStatus(t, *rr, http.StatusForbidden)
+	got := JSONError{}
+	if err := json.NewDecoder(rr.Body).Decode(&got); err != nil {
+		t.Errorf("Error decoding json: %s", err)
+	}
+	if got.ErrorType != Forbidden.Type {
+		t.Errorf("Got error type: %s, Wanted: %s", got.ErrorType, Forbidden.Type)
+	}
+	if server.Storage.IsDisabled(peterUsername) {
+		t.Errorf("User was disabled without the required scope.")
+	}
+
+	req = newDisableUserRequest(peterUsername)
+	req.Header.Set("Authorization", "Bearer "+portalSecret)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	testHTTPStatus(t, *rr, http.StatusOK)
+}
+
+func TestEndpointScopes(t *testing.T) {
+	setup()
+	router := newAuthRouter()
+	for endpoint := range endpointScopes {
+		req := httptest.NewRequest(http.MethodGet, "/"+endpoint, nil)
+		req.Header.Set("Authorization", "Bearer "+portalSecret)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if rr.Code == http.StatusNotFound {
+			t.Errorf("Endpoint %s has a scope but does not exist.", endpoint)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package api
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ClientConfigTemplate contains the settings of the server used to create wg-quick configuration files for clients.
+type ClientConfigTemplate struct {
+	// Host and port clients connect to, e.g. vpn.example.org:51820.
+	Endpoint string
+	// DNS servers used by clients, may be empty.
+	DNS []net.IP
+	// Traffic to these networks is sent through the tunnel by clients.
+	AllowedIPs []net.IPNet
+	// Interval in seconds in which clients send keepalive packets, 0 disables keepalive packets.
+	PersistentKeepalive int
+}
+
+func joinStrings(values []fmt.Stringer) string {
+	var strs []string
+	for _, value := range values {
+		strs = append(strs, value.String())
+	}
+	return strings.Join(strs, ", ")
+}
+
+// renderClientConfig returns a wg-quick configuration file for a client. If privateKey is nil, the PrivateKey line is
+// commented out so the client can fill in its own key. The preshared key is only included if the private key is
+// given, so it can not be retrieved by knowing only the public key.
+func (s *Server) renderClientConfig(config ClientConfig, privateKey *PrivateKey) string {
+	var addresses []fmt.Stringer
+	for _, ip := range config.IPs() {
+		ipNet := ipToIPNet(ip)
+		addresses = append(addresses, &ipNet)
+	}
+	var dns []fmt.Stringer
+	for _, ip := range s.clientConfigTemplate.DNS {
+		dns = append(dns, ip)
+	}
+	var allowedIPs []fmt.Stringer
+	for i := range s.clientConfigTemplate.AllowedIPs {
+		allowedIPs = append(allowedIPs, &s.clientConfigTemplate.AllowedIPs[i])
+	}
+
+	var b strings.Builder
+	b.WriteString("[Interface]\n")
+	if privateKey != nil {
+		fmt.Fprintf(&b, "PrivateKey = %s\n", privateKey)
+	} else {
+		b.WriteString("# PrivateKey = <private key of the client>\n")
+	}
+	fmt.Fprintf(&b, "Address = %s\n", joinStrings(addresses))
+	if len(dns) > 0 {
+		fmt.Fprintf(&b, "DNS = %s\n", joinStrings(dns))
+	}
+	b.WriteString("\n[Peer]\n")
+	fmt.Fprintf(&b, "PublicKey = %s\n", s.GetPublicKey())
+	if config.PresharedKey != nil {
+		if privateKey != nil {
+			fmt.Fprintf(&b, "PresharedKey = %s\n", config.PresharedKey)
+		} else {
+			b.WriteString("# PresharedKey = <preshared key of the client>\n")
+		}
+	}
+	fmt.Fprintf(&b, "AllowedIPs = %s\n", joinStrings(allowedIPs))
+	fmt.Fprintf(&b, "Endpoint = %s\n", s.clientConfigTemplate.Endpoint)
+	if s.clientConfigTemplate.PersistentKeepalive > 0 {
+		fmt.Fprintf(&b, "PersistentKeepalive = %d\n", s.clientConfigTemplate.PersistentKeepalive)
+	}
+	return b.String()
+}
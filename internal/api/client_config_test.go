@@ -0,0 +1,136 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func setupClientConfigTemplate() {
+	_, allIPv4, _ := net.ParseCIDR("0.0.0.0/0")
+	_, allIPv6, _ := net.ParseCIDR("::/0")
+	server.clientConfigTemplate = ClientConfigTemplate{
+		Endpoint:            "vpn.example.org:51820",
+		DNS:                 []net.IP{net.ParseIP("9.9.9.9"), net.ParseIP("2620:fe::fe")},
+		AllowedIPs:          []net.IPNet{*allIPv4, *allIPv6},
+		PersistentKeepalive: 25,
+	}
+}
+
+func TestRenderClientConfig(t *testing.T) {
+	setup()
+	setupClientConfigTemplate()
+	privateKey, _ := TestWGManager{}.GeneratePrivateKey()
+	config := ClientConfig{IP: net.ParseIP("10.0.0.4"), IPv6: net.ParseIP("fd00::4")}
+
+	got := server.renderClientConfig(config, &privateKey)
+	exp := "[Interface]\n" +
+		"PrivateKey = " + privateKey.String() + "\n" +
+		"Address = 10.0.0.4/32, fd00::4/128\n" +
+		"DNS = 9.9.9.9, 2620:fe::fe\n" +
+		"\n" +
+		"[Peer]\n" +
+		"PublicKey = " + server.GetPublicKey().String() + "\n" +
+		"AllowedIPs = 0.0.0.0/0, ::/0\n" +
+		"Endpoint = vpn.example.org:51820\n" +
+		"PersistentKeepalive = 25\n"
+	if got != exp {
+		t.Errorf("Got:\n%s\nWanted:\n%s", got, exp)
+	}
+
+	server.clientConfigTemplate.DNS = nil
+	server.clientConfigTemplate.PersistentKeepalive = 0
+	got = server.renderClientConfig(config, nil)
+	exp = "[Interface]\n" +
+		"# PrivateKey = <private key of the client>\n" +
+		"Address = 10.0.0.4/32, fd00::4/128\n" +
+		"\n" +
+		"[Peer]\n" +
+		"PublicKey = " + server.GetPublicKey().String() + "\n" +
+		"AllowedIPs = 0.0.0.0/0, ::/0\n" +
+		"Endpoint = vpn.example.org:51820\n"
+	if got != exp {
+		t.Errorf("Got:\n%s\nWanted:\n%s", got, exp)
+	}
+}
+
+func testGetClientConfig(t *testing.T, username string, publicKey string, privateKey string,
+	apiError *Error) string {
+
+	requestBody := url.Values{
+		"user_id":     {username},
+		"public_key":  {publicKey},
+		"private_key": {privateKey},
+	}
+	req, _ := http.NewRequest(http.MethodPost, "/client_config", bytes.NewBufferString(requestBody.Encode()))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+
+	respRec := httptest.NewRecorder()
+	apiRouter.ServeHTTP(respRec, req)
+
+	testError(t, *respRec, apiError)
+	return respRec.Body.String()
+}
+
+func TestGetClientConfig(t *testing.T) {
+	setup()
+	testGetClientConfig(t, peterUsername, petersPublicKey1String, "", &ClientConfigUnavailable)
+
+	setupClientConfigTemplate()
+	testGetClientConfig(t, "Nick", petersPublicKey1String, "", &ConfigNotFound)
+	otherPrivateKey, _ := TestWGManager{}.GeneratePrivateKey()
+	testGetClientConfig(t, peterUsername, petersPublicKey1String, otherPrivateKey.String(), &InvalidPrivateKey)
+	testGetClientConfig(t, peterUsername, petersPublicKey1String, "invalid", &InvalidPrivateKey)
+
+	got := testGetClientConfig(t, peterUsername, petersPublicKey1String, "", nil)
+	if !strings.Contains(got, "Address = 10.0.0.1/32, fd00::1/128\n") {
+		t.Errorf("Client config does not contain the addresses of the config:\n%s", got)
+	}
+
+	privateKey, _ := TestWGManager{}.GeneratePrivateKey()
+	testCreateConfig(t, peterUsername, privateKey.PublicKey().String(), nil)
+	got = testGetClientConfig(t, peterUsername, privateKey.PublicKey().String(), privateKey.String(), nil)
+	if !strings.Contains(got, "PrivateKey = "+privateKey.String()+"\n") {
+		t.Errorf("Client config does not contain the private key:\n%s", got)
+	}
+}
+
+func TestCreateConfigWithClientConfig(t *testing.T) {
+	setup()
+	requestBody := url.Values{
+		"user_id":       {peterUsername},
+		"client_config": {"true"},
+	}
+	newRequest := func() *http.Request {
+		req, _ := http.NewRequest(http.MethodPost, "/create_config_and_key_pair",
+			bytes.NewBufferString(requestBody.Encode()))
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		return req
+	}
+
+	respRec := httptest.NewRecorder()
+	apiRouter.ServeHTTP(respRec, newRequest())
+	testError(t, *respRec, &ClientConfigUnavailable)
+	if len(server.Storage.GetUserClients(peterUsername)) != 3 {
+		t.Errorf("Config was created while the client config is unavailable.")
+	}
+
+	setupClientConfigTemplate()
+	respRec = httptest.NewRecorder()
+	apiRouter.ServeHTTP(respRec, newRequest())
+	testError(t, *respRec, nil)
+
+	response := createConfigAndKeyPairResponse{}
+	if err := json.NewDecoder(respRec.Body).Decode(&response); err != nil {
+		t.Fatalf("Error decoding JSON: %s", err)
+	}
+	exp := server.renderClientConfig(ClientConfig{IP: response.IP, IPv6: response.IPv6}, &response.ClientPrivateKey)
+	if response.ClientConfig != exp {
+		t.Errorf("Got:\n%s\nWanted:\n%s", response.ClientConfig, exp)
+	}
+}
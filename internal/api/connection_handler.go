@@ -4,18 +4,32 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/fantostisch/wireguard-daemon/wgmanager"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
 type ConnectionHandler struct {
 	wgManager wgmanager.IWGManager
-	storage   *FileStorage
+	storage   Storage
 }
 
 type Connection struct {
-	PublicKey  PublicKey `json:"publicKey"`
-	AllowedIPs []string  `json:"allowedIPs"`
+	PublicKey     PublicKey `json:"publicKey"`
+	AllowedIPs    []string  `json:"allowedIPs"`
+	LastHandshake TimeJ     `json:"lastHandshake"`
+	// Address the client last sent packets from.
+	Endpoint      string `json:"endpoint,omitempty"`
+	ReceiveBytes  int64  `json:"receiveBytes"`
+	TransmitBytes int64  `json:"transmitBytes"`
+}
+
+func endpointString(peer wgtypes.Peer) string {
+	if peer.Endpoint == nil {
+		return ""
+	}
+	return peer.Endpoint.String()
 }
 
 func (h ConnectionHandler) getConnections(w http.ResponseWriter) {
@@ -46,8 +60,12 @@ func (h ConnectionHandler) getConnections(w http.ResponseWriter) {
 			allowedIPsString = append(allowedIPsString, IP.String())
 		}
 		*userPeerList = append(*userPeerList, Connection{
-			PublicKey:  publicKey,
-			AllowedIPs: allowedIPsString,
+			PublicKey:     publicKey,
+			AllowedIPs:    allowedIPsString,
+			LastHandshake: TimeJ{peer.LastHandshakeTime.UTC()},
+			Endpoint:      endpointString(peer),
+			ReceiveBytes:  peer.ReceiveBytes,
+			TransmitBytes: peer.TransmitBytes,
 		})
 	}
 
@@ -57,3 +75,53 @@ func (h ConnectionHandler) getConnections(w http.ResponseWriter) {
 		return
 	}
 }
+
+type ConfigStatus struct {
+	// Active is true if the config is added to WireGuard. Configs of disabled users and expired configs are not active.
+	Active bool `json:"active"`
+	// Connected is true if a handshake has been performed in the last 3 minutes.
+	Connected bool `json:"connected"`
+	// Time of the last handshake, null if no handshake has been performed since the peer was added to WireGuard.
+	LastHandshake *TimeJ `json:"lastHandshake"`
+	Endpoint      string `json:"endpoint,omitempty"`
+	ReceiveBytes  int64  `json:"receiveBytes"`
+	TransmitBytes int64  `json:"transmitBytes"`
+}
+
+// getConfigStatus replies with the status of a config in WireGuard, also if the client is not connected.
+func (h ConnectionHandler) getConfigStatus(w http.ResponseWriter, username UserID, publicKey PublicKey) {
+	if _, exists := h.storage.GetUserClients(username)[publicKey]; !exists {
+		message := fmt.Sprintf(
+			"Config not found: User '%s' does not have a config with public key '%s'", username, publicKey.String())
+		replyWithError(w, ConfigNotFound, message)
+		return
+	}
+
+	peers, err := h.wgManager.GetPeers()
+	if err != nil {
+		message := fmt.Sprintf("Error getting WireGuard peers: %s", err)
+		http.Error(w, message, http.StatusInternalServerError)
+		return
+	}
+
+	status := ConfigStatus{}
+	for _, peer := range peers {
+		if peer.PublicKey != publicKey.Key {
+			continue
+		}
+		status.Active = true
+		status.Connected = wgmanager.IsConnected(peer, time.Now())
+		if !peer.LastHandshakeTime.IsZero() {
+			status.LastHandshake = &TimeJ{peer.LastHandshakeTime.UTC()}
+		}
+		status.Endpoint = endpointString(peer)
+		status.ReceiveBytes = peer.ReceiveBytes
+		status.TransmitBytes = peer.TransmitBytes
+	}
+
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		message := fmt.Sprintf("Error encoding response as JSON: %s", err)
+		http.Error(w, message, http.StatusInternalServerError)
+		return
+	}
+}
@@ -5,6 +5,9 @@ import (
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -67,7 +70,7 @@ func TestGetConnections(t *testing.T) {
 	}
 
 	storage := FileStorage{
-		filePath: "/dev/null",
+		filePath: filepath.Join(testStorageDir, "storage.json"),
 		data: data{
 			Users: map[UserID]*User{
 				peterUsername: &User{
@@ -92,8 +95,12 @@ func TestGetConnections(t *testing.T) {
 	testHTTPStatus(t, *respRec, http.StatusOK)
 
 	type ConnectionString struct {
-		PublicKey  string   `json:"publicKey"`
-		AllowedIPs []string `json:"allowedIPs"`
+		PublicKey     string   `json:"publicKey"`
+		AllowedIPs    []string `json:"allowedIPs"`
+		LastHandshake string   `json:"lastHandshake"`
+		Endpoint      string   `json:"endpoint"`
+		ReceiveBytes  int64    `json:"receiveBytes"`
+		TransmitBytes int64    `json:"transmitBytes"`
 	}
 
 	var got map[string][]ConnectionString
@@ -104,14 +111,79 @@ func TestGetConnections(t *testing.T) {
 
 	exp := map[string][]ConnectionString{
 		peterUsername: {ConnectionString{
-			PublicKey:  petersPublicKeyString,
-			AllowedIPs: []string{"2.71.82.81/32"},
+			PublicKey:     petersPublicKeyString,
+			AllowedIPs:    []string{"2.71.82.81/32"},
+			LastHandshake: "2020-10-12T14:05:52Z",
+			Endpoint:      "3.141.59.26:4000",
+			ReceiveBytes:  9,
+			TransmitBytes: 2,
 		}}, "Arthur": {ConnectionString{
-			PublicKey:  arthursPublicKeyString,
-			AllowedIPs: []string{"1.61.6.255/32"},
+			PublicKey:     arthursPublicKeyString,
+			AllowedIPs:    []string{"1.61.6.255/32"},
+			LastHandshake: "2020-10-12T14:06:52Z",
+			Endpoint:      "6.62.60.70%zone:5000",
+			ReceiveBytes:  15,
+			TransmitBytes: 25,
 		}},
 	}
 	if !cmp.Equal(got, exp) {
 		t.Error("Diff: ", cmp.Diff(exp, got))
 	}
 }
+
+func TestGetConfigStatus(t *testing.T) {
+	setup()
+	petersPublicKey1, _ := wgtypes.ParseKey(petersPublicKey1String)
+	petersPublicKey2, _ := wgtypes.ParseKey(petersPublicKey2String)
+	lastHandshake := time.Now().Add(-time.Minute).UTC().Truncate(time.Second)
+	router := API{
+		ConnectionHandler: ConnectionHandler{
+			wgManager: TestWGManager{
+				getPeersPeerList: []wgtypes.Peer{
+					{
+						PublicKey:         petersPublicKey1,
+						Endpoint:          &net.UDPAddr{IP: net.IPv4(3, 141, 59, 26), Port: 4000},
+						LastHandshakeTime: lastHandshake,
+						ReceiveBytes:      9,
+						TransmitBytes:     2,
+					},
+					{PublicKey: petersPublicKey2},
+				},
+			},
+			storage: server.Storage,
+		},
+	}
+
+	var tests = []struct {
+		username  string
+		publicKey string
+		apiError  *Error
+		exp       string
+	}{
+		{peterUsername, petersPublicKey1String, nil, `{"active":true,"connected":true,"lastHandshake":"` +
+			lastHandshake.Format(time.RFC3339) + `","endpoint":"3.141.59.26:4000","receiveBytes":9,"transmitBytes":2}`},
+		{peterUsername, petersPublicKey2String, nil,
+			`{"active":true,"connected":false,"lastHandshake":null,"receiveBytes":0,"transmitBytes":0}`},
+		{peterUsername, petersPublicKey3String, nil,
+			`{"active":false,"connected":false,"lastHandshake":null,"receiveBytes":0,"transmitBytes":0}`},
+		{"Nick", petersPublicKey1String, &ConfigNotFound, ""},
+	}
+
+	for _, test := range tests {
+		parameters := url.Values{
+			"user_id":    {test.username},
+			"public_key": {test.publicKey},
+		}
+		req, _ := http.NewRequest(http.MethodGet, "/config_status?"+parameters.Encode(), nil)
+		respRec := httptest.NewRecorder()
+		router.ServeHTTP(respRec, req)
+
+		testError(t, *respRec, test.apiError)
+		if test.apiError != nil {
+			continue
+		}
+		if got := strings.TrimSpace(respRec.Body.String()); got != test.exp {
+			t.Errorf("Got: %s, Wanted: %s", got, test.exp)
+		}
+	}
+}
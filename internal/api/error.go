@@ -10,10 +10,34 @@ var (
 	MissingPostParameter = Error{"missing_post_parameter"}
 	UserIDNotSupplied    = Error{"user_id_not_supplied"}
 	InvalidPublicKey     = Error{"invalid_public_key"}
+	InvalidPrivateKey    = Error{"invalid_private_key"}
 	ConfigNotFound       = Error{"config_not_found"}
 	UserAlreadyEnabled   = Error{"user_already_enabled"}
 	UserAlreadyDisabled  = Error{"user_already_disabled"}
 	NoIPAvailable        = Error{"no_ip_available"}
+	UnknownPool          = Error{"unknown_pool"}
+	ConfigLimitReached   = Error{"config_limit_reached"}
+	InvalidConfigLimit   = Error{"invalid_config_limit"}
+	InvalidQuota         = Error{"invalid_quota"}
+	Unauthorized         = Error{"unauthorized"}
+	Forbidden            = Error{"forbidden"}
+	// ClientConfigUnavailable is returned when client configuration files are requested but the endpoint of the
+	// server is not configured.
+	ClientConfigUnavailable = Error{"client_config_unavailable"}
+	InvalidQRCodeFormat     = Error{"invalid_qr_code_format"}
+	InvalidAllowedIPs       = Error{"invalid_allowed_ips"}
+	AllowedIPsOverlap       = Error{"allowed_ips_overlap"}
+	InvalidKeepalive        = Error{"invalid_persistent_keepalive"}
+	InvalidExpiry           = Error{"invalid_expiry"}
+	InvalidName             = Error{"invalid_name"}
+	InvalidMetadata         = Error{"invalid_metadata"}
+	// UsageUnavailable is returned when usage is requested but traffic accounting is disabled.
+	UsageUnavailable = Error{"usage_unavailable"}
+	// SessionsUnavailable is returned when sessions are requested but recording sessions is disabled.
+	SessionsUnavailable = Error{"sessions_unavailable"}
+	InvalidTimeRange    = Error{"invalid_time_range"}
+	// UserDisabled is returned when a disabled user creates a config while disabled users do not keep addresses.
+	UserDisabled = Error{"user_disabled"}
 )
 
 type Error struct {
@@ -30,12 +54,16 @@ type JSONError struct {
 }
 
 func replyWithError(w http.ResponseWriter, apiError Error, message string) {
+	replyWithErrorStatus(w, http.StatusBadRequest, apiError, message)
+}
+
+func replyWithErrorStatus(w http.ResponseWriter, statusCode int, apiError Error, message string) {
 	jsonAPIError := JSONError{
 		ErrorType:        apiError.Type,
 		ErrorDescription: message,
 	}
 
-	w.WriteHeader(http.StatusBadRequest)
+	w.WriteHeader(statusCode)
 
 	if err := json.NewEncoder(w).Encode(jsonAPIError); err != nil {
 		message := fmt.Sprintf("Error encoding response as JSON: %s", err)
@@ -5,16 +5,30 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"log"
 	"net"
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
 )
 
 type FileStorage struct {
 	filePath  string
 	dataMutex sync.RWMutex
 	data      data
+	// Amount of configs using every address, so checking if an address is used does not go through all configs. Built
+	// on first use, protected by dataMutex.
+	usedAddresses map[string]int
+	// Called with the duration of every write of the storage file, may be nil.
+	observeWrite func(duration time.Duration)
+	// Incremented for every change, protected by dataMutex.
+	writeSeq uint64
+	// Locked while the storage file is written.
+	writeMutex sync.Mutex
+	// Sequence number of the last written change, protected by writeMutex. Writes of older changes are skipped, so the
+	// file is not replaced by older data.
+	lastWrittenSeq uint64
 }
 
 type data struct {
@@ -38,16 +52,60 @@ func NewFileStorage(filePath string) error {
 	}
 }
 
+// corruptStorageError is returned if the storage file could be read but not be decoded.
+type corruptStorageError struct {
+	filePath string
+	err      error
+}
+
+func (e *corruptStorageError) Error() string {
+	return fmt.Sprintf("failed to parse storage file %s: %s", e.filePath, e.err)
+}
+
+func (e *corruptStorageError) Unwrap() error {
+	return e.err
+}
+
+// ReadFile reads the storage file. If the storage file is corrupt, for example because the disk was full, the backup
+// created by the last write is read instead and the corrupt file is renamed. Other errors, like missing permissions,
+// are returned.
 func ReadFile(filePath string) (*FileStorage, error) {
-	file, err := os.Open(filepath.Clean(filePath))
+	storage, err := readFile(filePath)
+	var corruptErr *corruptStorageError
+	if !errors.As(err, &corruptErr) {
+		return storage, err
+	}
+	// The backup is created next to the file a symbolic link points to.
+	resolvedPath, _, resolveErr := resolveStoragePath(filePath)
+	if resolveErr != nil {
+		return nil, resolveErr
+	}
+	backupPath := resolvedPath + ".bak"
+	storage, backupErr := readFile(backupPath)
+	if backupErr != nil {
+		return nil, fmt.Errorf("%w, reading backup %s failed: %s", err, backupPath, backupErr)
+	}
+	corruptPath := fmt.Sprintf("%s.corrupt-%d", resolvedPath, time.Now().Unix())
+	if err := os.Rename(resolvedPath, corruptPath); err != nil {
+		return nil, fmt.Errorf("error moving corrupt storage file: %w", err)
+	}
+	storage.filePath = filePath
+	log.Printf("WARNING: %s. Using backup %s, changes made after the backup was created are lost. "+
+		"The corrupt file was moved to %s.", err, backupPath, corruptPath)
+	return storage, nil
+}
+
+func readFile(filePath string) (*FileStorage, error) {
+	// The file is read before decoding, so errors reading it are not mistaken for a corrupt file.
+	content, err := ioutil.ReadFile(filepath.Clean(filePath))
 	if err != nil {
 		return nil, fmt.Errorf("could not read storage file: %w", err)
 	}
 	storage := &FileStorage{
 		filePath: filePath,
 	}
-	if err = json.NewDecoder(file).Decode(&storage.data); err != nil {
-		return nil, fmt.Errorf("failed to parse storage file: %w", err)
+	if err = json.Unmarshal(content, &storage.data); err != nil {
+		return nil, &corruptStorageError{filePath: filePath, err: err}
 	}
 	return storage, nil
 }
@@ -56,22 +114,182 @@ func ReadFile(filePath string) (*FileStorage, error) {
 // Mutex should already be locked, we will unlock it before writing everything to disk.
 func (s *FileStorage) write() error {
 	data, err := json.MarshalIndent(s.data, "", "  ")
+	observeWrite := s.observeWrite
+	s.writeSeq++
+	seq := s.writeSeq
 	s.dataMutex.Unlock()
 	if err != nil {
 		return err
 	}
-	return ioutil.WriteFile(s.filePath, data, 0600)
+
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+	if seq < s.lastWrittenSeq {
+		// A newer change has been written, which includes this change.
+		return nil
+	}
+	start := time.Now()
+	err = writeFileAtomically(s.filePath, data)
+	if observeWrite != nil {
+		observeWrite(time.Since(start))
+	}
+	if err == nil {
+		s.lastWrittenSeq = seq
+	}
+	return err
+}
+
+// writeFileAtomically replaces the file with data, after a crash the file contains either the old or the new data. The
+// data is written to a temporary file in the same directory which is renamed to the file. The old file is kept as
+// backup with extension .bak. If the file is a symbolic link, the file it points to is replaced.
+func writeFileAtomically(filePath string, data []byte) error {
+	filePath, exists, err := resolveStoragePath(filePath)
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(filePath)
+	tempFile, err := ioutil.TempFile(dir, filepath.Base(filePath)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tempFile.Write(data); err != nil {
+		_ = tempFile.Close()
+		_ = os.Remove(tempFile.Name())
+		return err
+	}
+	if err := tempFile.Sync(); err != nil {
+		_ = tempFile.Close()
+		_ = os.Remove(tempFile.Name())
+		return err
+	}
+	if err := tempFile.Close(); err != nil {
+		_ = os.Remove(tempFile.Name())
+		return err
+	}
+
+	if exists {
+		// The backup is a hard link, so the file exists under its own name at all times.
+		backupPath := filePath + ".bak"
+		if err := os.Remove(backupPath); err != nil && !os.IsNotExist(err) {
+			_ = os.Remove(tempFile.Name())
+			return fmt.Errorf("error removing old backup: %w", err)
+		}
+		if err := os.Link(filePath, backupPath); err != nil {
+			_ = os.Remove(tempFile.Name())
+			return fmt.Errorf("error creating backup: %w", err)
+		}
+	}
+	if err := os.Rename(tempFile.Name(), filePath); err != nil {
+		_ = os.Remove(tempFile.Name())
+		return err
+	}
+
+	// The rename is only durable after the directory is synced.
+	dirFile, err := os.Open(filepath.Clean(dir))
+	if err != nil {
+		return err
+	}
+	if err := dirFile.Sync(); err != nil {
+		_ = dirFile.Close()
+		return err
+	}
+	return dirFile.Close()
+}
+
+// resolveStoragePath follows symbolic links, so the file they point to is replaced instead of the links. Returns if
+// the file exists.
+func resolveStoragePath(filePath string) (string, bool, error) {
+	resolved, err := filepath.EvalSymlinks(filePath)
+	if os.IsNotExist(err) {
+		return filePath, false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return resolved, true, nil
+}
+
+// CheckWritable returns an error if the storage file can not be written. Writing creates a temporary file in the
+// directory of the storage file, so the directory must be writable.
+func (s *FileStorage) CheckWritable() error {
+	filePath, _, err := resolveStoragePath(s.filePath)
+	if err != nil {
+		return err
+	}
+	tempFile, err := ioutil.TempFile(filepath.Dir(filePath), filepath.Base(filePath)+".tmp")
+	if err != nil {
+		return err
+	}
+	_ = tempFile.Close()
+	return os.Remove(tempFile.Name())
+}
+
+func (s *FileStorage) SetWriteObserver(observeWrite func(duration time.Duration)) {
+	s.dataMutex.Lock()
+	defer s.dataMutex.Unlock()
+
+	s.observeWrite = observeWrite
 }
 
 func (s *FileStorage) GetUserClients(username UserID) map[PublicKey]ClientConfig {
 	s.dataMutex.Lock()
 	defer s.dataMutex.Unlock()
 
+	clients := map[PublicKey]ClientConfig{}
 	userConfig := s.data.Users[username]
 	if userConfig == nil {
-		return map[PublicKey]ClientConfig{}
+		return clients
+	}
+	for publicKey, config := range userConfig.Clients {
+		clients[publicKey] = config
+	}
+	return clients
+}
+
+// GetAllUsers returns a copy of all users.
+func (s *FileStorage) GetAllUsers() map[UserID]User {
+	s.dataMutex.Lock()
+	defer s.dataMutex.Unlock()
+
+	users := map[UserID]User{}
+	for username, user := range s.data.Users {
+		userCopy := *user
+		userCopy.Clients = map[PublicKey]ClientConfig{}
+		for publicKey, config := range user.Clients {
+			userCopy.Clients[publicKey] = config
+		}
+		users[username] = userCopy
+	}
+	return users
+}
+
+// GetAllClients returns the configs of all users.
+func (s *FileStorage) GetAllClients() map[PublicKey]ClientConfig {
+	s.dataMutex.Lock()
+	defer s.dataMutex.Unlock()
+
+	clients := map[PublicKey]ClientConfig{}
+	for _, user := range s.data.Users {
+		for publicKey, config := range user.Clients {
+			clients[publicKey] = config
+		}
 	}
-	return userConfig.Clients
+	return clients
+}
+
+// GetUsernames returns the user of every config.
+func (s *FileStorage) GetUsernames() map[PublicKey]UserID {
+	s.dataMutex.Lock()
+	defer s.dataMutex.Unlock()
+
+	usernames := map[PublicKey]UserID{}
+	for username, user := range s.data.Users {
+		for publicKey := range user.Clients {
+			usernames[publicKey] = username
+		}
+	}
+	return usernames
 }
 
 func (s *FileStorage) GetUsernameAndConfig(publicKey PublicKey) (UserID, ClientConfig, error) {
@@ -101,25 +319,103 @@ func (s *FileStorage) getOrCreateUser(username UserID) *User {
 	return user
 }
 
-func (s *FileStorage) UpdateOrCreateConfig(username UserID, publicKey PublicKey, config ClientConfig) (bool, error) {
+func (s *FileStorage) UpdateOrCreateConfig(username UserID, publicKey PublicKey, config ClientConfig,
+	maxConfigs int) (bool, error) {
+
 	s.dataMutex.Lock()
 
-	allocatedIPs := s.getAllocatedIPsUnsafe()
+	if user := s.data.Users[username]; user != nil && maxConfigs > 0 && len(user.Clients) >= maxConfigs {
+		if _, exists := user.Clients[publicKey]; !exists {
+			s.dataMutex.Unlock()
+			return false, &ConfigLimitReached
+		}
+	}
 
-	allocated := false
-	for _, allocatedIP := range allocatedIPs {
-		if allocatedIP.Equal(config.IP) {
-			allocated = true
-			break
+	usedAddresses := s.getUsedAddressesUnsafe()
+	for _, ip := range config.IPs() {
+		if usedAddresses[ip.String()] > 0 {
+			s.dataMutex.Unlock()
+			return false, nil
 		}
 	}
-	if allocated {
+
+	s.setConfigUnsafe(s.getOrCreateUser(username), publicKey, config)
+	return true, s.write()
+}
+
+// getUsedAddressesUnsafe returns the amount of configs using every address. Mutex should be locked.
+func (s *FileStorage) getUsedAddressesUnsafe() map[string]int {
+	if s.usedAddresses == nil {
+		s.usedAddresses = map[string]int{}
+		for _, ip := range s.getAllocatedIPsUnsafe() {
+			s.usedAddresses[ip.String()]++
+		}
+	}
+	return s.usedAddresses
+}
+
+// setConfigUnsafe saves a config of a user and updates the used addresses. Mutex should be locked.
+func (s *FileStorage) setConfigUnsafe(user *User, publicKey PublicKey, config ClientConfig) {
+	if oldConfig, exists := user.Clients[publicKey]; exists {
+		s.countAddressesUnsafe(oldConfig, -1)
+	}
+	user.Clients[publicKey] = config
+	s.countAddressesUnsafe(config, 1)
+}
+
+// deleteConfigUnsafe deletes a config of a user, if it exists, and updates the used addresses. Mutex should be locked.
+func (s *FileStorage) deleteConfigUnsafe(user *User, publicKey PublicKey) {
+	if config, exists := user.Clients[publicKey]; exists {
+		s.countAddressesUnsafe(config, -1)
+		delete(user.Clients, publicKey)
+	}
+}
+
+// countAddressesUnsafe changes the amount of configs using the addresses of config by delta. Mutex should be locked.
+func (s *FileStorage) countAddressesUnsafe(config ClientConfig, delta int) {
+	usedAddresses := s.getUsedAddressesUnsafe()
+	for _, ip := range config.IPs() {
+		if usedAddresses[ip.String()] += delta; usedAddresses[ip.String()] <= 0 {
+			delete(usedAddresses, ip.String())
+		}
+	}
+}
+
+// UpdateConfigs calls update for every config of the user and saves the changes.
+func (s *FileStorage) UpdateConfigs(username UserID, update func(publicKey PublicKey, config *ClientConfig)) error {
+	s.dataMutex.Lock()
+
+	user := s.data.Users[username]
+	if user == nil {
 		s.dataMutex.Unlock()
-		return false, nil
+		return nil
+	}
+	for publicKey, config := range user.Clients {
+		update(publicKey, &config)
+		s.setConfigUnsafe(user, publicKey, config)
 	}
+	return s.write()
+}
 
-	s.getOrCreateUser(username).Clients[publicKey] = config
-	return true, s.write()
+// UpdateConfig calls update for a config and saves the changes. Returns the updated config and if the config exists.
+func (s *FileStorage) UpdateConfig(username UserID, publicKey PublicKey,
+	update func(config *ClientConfig)) (ClientConfig, bool, error) {
+
+	s.dataMutex.Lock()
+
+	user := s.data.Users[username]
+	if user == nil {
+		s.dataMutex.Unlock()
+		return ClientConfig{}, false, nil
+	}
+	config, exists := user.Clients[publicKey]
+	if !exists {
+		s.dataMutex.Unlock()
+		return ClientConfig{}, false, nil
+	}
+	update(&config)
+	s.setConfigUnsafe(user, publicKey, config)
+	return config, true, s.write()
 }
 
 // Return true if config was successfully deleted, false otherwise.
@@ -136,7 +432,7 @@ func (s *FileStorage) DeleteConfig(username UserID, publicKey PublicKey) (bool,
 		s.dataMutex.Unlock()
 		return false, nil
 	}
-	delete(user.Clients, publicKey)
+	s.deleteConfigUnsafe(user, publicKey)
 	return true, s.write()
 }
 
@@ -144,7 +440,7 @@ func (s *FileStorage) GetEnabledUsers() []User {
 	s.dataMutex.Lock()
 	defer s.dataMutex.Unlock()
 
-	enabledUsers := make([]User, len(s.data.Users))
+	enabledUsers := make([]User, 0, len(s.data.Users))
 	for _, user := range s.data.Users {
 		if !user.IsDisabled {
 			enabledUsers = append(enabledUsers, *user)
@@ -153,24 +449,105 @@ func (s *FileStorage) GetEnabledUsers() []User {
 	return enabledUsers
 }
 
-// SetDisabled disables or enables a user and returns if the value was changed
-func (s *FileStorage) SetDisabled(username UserID, disabled bool) (bool, error) {
+func (s *FileStorage) IsDisabled(username UserID) bool {
+	s.dataMutex.Lock()
+	defer s.dataMutex.Unlock()
+
+	user := s.data.Users[username]
+	return user != nil && user.IsDisabled
+}
+
+// GetDisabledReason returns the reason a user is disabled, NotDisabled if the user is enabled.
+func (s *FileStorage) GetDisabledReason(username UserID) DisabledReason {
+	s.dataMutex.Lock()
+	defer s.dataMutex.Unlock()
+
+	user := s.data.Users[username]
+	if user == nil {
+		return NotDisabled
+	}
+	return user.disabledReason()
+}
+
+// SetDisabled disables a user for reason, or enables the user if reason is NotDisabled, and returns the previous
+// reason.
+func (s *FileStorage) SetDisabled(username UserID, reason DisabledReason) (DisabledReason, error) {
 	s.dataMutex.Lock()
 
 	user := s.getOrCreateUser(username)
-	if user.IsDisabled == disabled {
+	previous := user.disabledReason()
+	if previous == reason {
 		s.dataMutex.Unlock()
-		return false, nil
+		return previous, nil
 	}
-	user.IsDisabled = disabled
-	return true, s.write()
+	user.IsDisabled = reason != NotDisabled
+	user.DisabledReason = reason
+	return previous, s.write()
+}
+
+// GetUserPool returns the pool used for new configs of the user, an empty string if the user has no default pool.
+func (s *FileStorage) GetUserPool(username UserID) string {
+	s.dataMutex.Lock()
+	defer s.dataMutex.Unlock()
+
+	user := s.data.Users[username]
+	if user == nil {
+		return ""
+	}
+	return user.Pool
+}
+
+func (s *FileStorage) SetUserPool(username UserID, pool string) error {
+	s.dataMutex.Lock()
+
+	s.getOrCreateUser(username).Pool = pool
+	return s.write()
+}
+
+// GetMaxConfigs returns the maximum amount of configs of the user, nil if the default of the server should be used.
+func (s *FileStorage) GetMaxConfigs(username UserID) *int {
+	s.dataMutex.Lock()
+	defer s.dataMutex.Unlock()
+
+	user := s.data.Users[username]
+	if user == nil {
+		return nil
+	}
+	return user.MaxConfigs
+}
+
+func (s *FileStorage) SetMaxConfigs(username UserID, maxConfigs *int) error {
+	s.dataMutex.Lock()
+
+	s.getOrCreateUser(username).MaxConfigs = maxConfigs
+	return s.write()
+}
+
+// GetMonthlyQuota returns the monthly traffic quota of the user in bytes, nil if the default of the server should be
+// used.
+func (s *FileStorage) GetMonthlyQuota(username UserID) *int64 {
+	s.dataMutex.Lock()
+	defer s.dataMutex.Unlock()
+
+	user := s.data.Users[username]
+	if user == nil {
+		return nil
+	}
+	return user.MonthlyQuota
+}
+
+func (s *FileStorage) SetMonthlyQuota(username UserID, monthlyQuota *int64) error {
+	s.dataMutex.Lock()
+
+	s.getOrCreateUser(username).MonthlyQuota = monthlyQuota
+	return s.write()
 }
 
 func (s *FileStorage) getAllocatedIPsUnsafe() []net.IP {
 	allocatedIPs := []net.IP{}
 	for _, user := range s.data.Users {
 		for _, client := range user.Clients {
-			allocatedIPs = append(allocatedIPs, client.IP)
+			allocatedIPs = append(allocatedIPs, client.IPs()...)
 		}
 	}
 	return allocatedIPs
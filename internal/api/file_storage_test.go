@@ -0,0 +1,230 @@
+package api
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testStorageDir contains the storage file of the server used by the tests.
+var testStorageDir string
+
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "storage")
+	if err != nil {
+		log.Fatal(err)
+	}
+	testStorageDir = dir
+	code := m.Run()
+	_ = os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func newTestStorageDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func TestWriteStorage(t *testing.T) {
+	dir, cleanup := newTestStorageDir(t)
+	defer cleanup()
+	filePath := filepath.Join(dir, "storage.json")
+
+	if err := NewFileStorage(filePath); err != nil {
+		t.Fatalf("Error creating storage: %s", err)
+	}
+	storage, err := ReadFile(filePath)
+	if err != nil {
+		t.Fatalf("Error reading storage: %s", err)
+	}
+	if err := storage.SetUserPool(peterUsername, "staff"); err != nil {
+		t.Fatalf("Error writing storage: %s", err)
+	}
+
+	// The backup contains the storage before the last write.
+	backup, err := readFile(filePath + ".bak")
+	if err != nil {
+		t.Fatalf("Error reading backup: %s", err)
+	}
+	if len(backup.data.Users) != 0 {
+		t.Errorf("Backup contains users: %v", backup.data.Users)
+	}
+	storage, err = ReadFile(filePath)
+	if err != nil {
+		t.Fatalf("Error reading storage: %s", err)
+	}
+	if storage.GetUserPool(peterUsername) != "staff" {
+		t.Error("Change was not written")
+	}
+
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 2 {
+		t.Errorf("Expected storage file and backup, got %d files", len(files))
+	}
+	if err := storage.CheckWritable(); err != nil {
+		t.Errorf("Storage is not writable: %s", err)
+	}
+}
+
+func TestReadCorruptStorage(t *testing.T) {
+	dir, cleanup := newTestStorageDir(t)
+	defer cleanup()
+	filePath := filepath.Join(dir, "storage.json")
+
+	if err := NewFileStorage(filePath); err != nil {
+		t.Fatalf("Error creating storage: %s", err)
+	}
+	storage, _ := ReadFile(filePath)
+	if err := storage.SetUserPool(peterUsername, "staff"); err != nil {
+		t.Fatalf("Error writing storage: %s", err)
+	}
+	if err := storage.SetUserPool(peterUsername, "guests"); err != nil {
+		t.Fatalf("Error writing storage: %s", err)
+	}
+	// A write was interrupted.
+	if err := ioutil.WriteFile(filePath, []byte(`{"users": {"Pet`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	storage, err := ReadFile(filePath)
+	if err != nil {
+		t.Fatalf("Error reading storage: %s", err)
+	}
+	if storage.GetUserPool(peterUsername) != "staff" {
+		t.Errorf("Backup was not used, pool: %s", storage.GetUserPool(peterUsername))
+	}
+	// The corrupt file is kept and does not become the backup at the next write.
+	if err := storage.SetUserPool(peterUsername, "guests"); err != nil {
+		t.Fatalf("Error writing storage: %s", err)
+	}
+	backup, _ := readFile(filePath + ".bak")
+	if backup.GetUserPool(peterUsername) != "staff" {
+		t.Errorf("Backup was overwritten, pool: %s", backup.GetUserPool(peterUsername))
+	}
+	corruptFiles, _ := filepath.Glob(filePath + ".corrupt-*")
+	if len(corruptFiles) != 1 {
+		t.Errorf("Expected 1 corrupt file, got %v", corruptFiles)
+	}
+
+	// Without valid backup the storage can not be read.
+	if err := ioutil.WriteFile(filePath+".bak", []byte{}, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filePath, []byte{}, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadFile(filePath); err == nil || !strings.Contains(err.Error(), "reading backup") {
+		t.Errorf("Expected error reading backup, got: %v", err)
+	}
+}
+
+func TestWriteStorageSymlink(t *testing.T) {
+	dir, cleanup := newTestStorageDir(t)
+	defer cleanup()
+	filePath := filepath.Join(dir, "data", "storage.json")
+	linkPath := filepath.Join(dir, "storage.json")
+
+	if err := os.Mkdir(filepath.Dir(filePath), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewFileStorage(filePath); err != nil {
+		t.Fatalf("Error creating storage: %s", err)
+	}
+	if err := os.Symlink(filePath, linkPath); err != nil {
+		t.Fatal(err)
+	}
+	storage, err := ReadFile(linkPath)
+	if err != nil {
+		t.Fatalf("Error reading storage: %s", err)
+	}
+	if err := storage.CheckWritable(); err != nil {
+		t.Errorf("Storage is not writable: %s", err)
+	}
+	if err := storage.SetUserPool(peterUsername, "staff"); err != nil {
+		t.Fatalf("Error writing storage: %s", err)
+	}
+
+	// The file the link points to is replaced and the link is kept.
+	if info, err := os.Lstat(linkPath); err != nil || info.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("Link was replaced: %v", err)
+	}
+	written, err := readFile(filePath)
+	if err != nil {
+		t.Fatalf("Error reading storage: %s", err)
+	}
+	if written.GetUserPool(peterUsername) != "staff" {
+		t.Error("Change was not written to the file the link points to")
+	}
+	if _, err := os.Stat(filePath + ".bak"); err != nil {
+		t.Errorf("Backup was not created next to the file: %s", err)
+	}
+}
+
+func TestReadUnreadableStorage(t *testing.T) {
+	dir, cleanup := newTestStorageDir(t)
+	defer cleanup()
+	filePath := filepath.Join(dir, "storage.json")
+
+	if err := NewFileStorage(filePath); err != nil {
+		t.Fatalf("Error creating storage: %s", err)
+	}
+	storage, _ := ReadFile(filePath)
+	if err := storage.SetUserPool(peterUsername, "staff"); err != nil {
+		t.Fatalf("Error writing storage: %s", err)
+	}
+	// Reading a directory fails, also for root which is not restricted by permissions.
+	if err := os.Remove(filePath); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filePath, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only corrupt files are replaced by the backup.
+	if _, err := ReadFile(filePath); err == nil || !strings.Contains(err.Error(), "could not read storage file") {
+		t.Errorf("Expected error reading storage, got: %v", err)
+	}
+	corruptFiles, _ := filepath.Glob(filePath + ".corrupt-*")
+	if len(corruptFiles) != 0 {
+		t.Errorf("Unreadable file was moved: %v", corruptFiles)
+	}
+}
+
+func TestConcurrentWrites(t *testing.T) {
+	dir, cleanup := newTestStorageDir(t)
+	defer cleanup()
+	filePath := filepath.Join(dir, "storage.json")
+
+	if err := NewFileStorage(filePath); err != nil {
+		t.Fatalf("Error creating storage: %s", err)
+	}
+	storage, _ := ReadFile(filePath)
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := storage.SetUserPool(UserID(fmt.Sprint(i)), "staff"); err != nil {
+				t.Errorf("Error writing storage: %s", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// The last write contains all changes.
+	written, err := ReadFile(filePath)
+	if err != nil {
+		t.Fatalf("Error reading storage: %s", err)
+	}
+	if got := len(written.GetAllUsers()); got != 20 {
+		t.Errorf("Got %d users, expected 20", got)
+	}
+}
@@ -0,0 +1,79 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+type checkResult struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+func newCheckResult(err error) checkResult {
+	if err != nil {
+		return checkResult{OK: false, Error: err.Error()}
+	}
+	return checkResult{OK: true}
+}
+
+type readinessResponse struct {
+	Ready  bool                   `json:"ready"`
+	Checks map[string]checkResult `json:"checks"`
+}
+
+// checkReadiness checks that WireGuard can be reached, that the peers in WireGuard match storage and that the storage
+// file can be written.
+func (s *Server) checkReadiness(now time.Time) readinessResponse {
+	_, wgErr := s.wgManager.GetPublicKey()
+	response := readinessResponse{
+		Ready: true,
+		Checks: map[string]checkResult{
+			"wireguard": newCheckResult(wgErr),
+			"peers":     newCheckResult(s.checkPeers(now)),
+			"storage":   newCheckResult(s.Storage.CheckWritable()),
+		},
+	}
+	for _, result := range response.Checks {
+		if !result.OK {
+			response.Ready = false
+		}
+	}
+	return response
+}
+
+// checkPeers returns an error if the peers in WireGuard do not match the active configs in storage.
+func (s *Server) checkPeers(now time.Time) error {
+	peers, err := s.wgManager.GetPeers()
+	if err != nil {
+		return fmt.Errorf("error getting WireGuard peers: %w", err)
+	}
+	if diff := diffPeers(s.expectedPeers(now), peers); !diff.empty() {
+		return fmt.Errorf("WireGuard does not match storage: %s", diff)
+	}
+	return nil
+}
+
+// getHealth replies if the daemon is running.
+func (h UserHandler) getHealth(w http.ResponseWriter) {
+	if err := json.NewEncoder(w).Encode(map[string]string{"status": "ok"}); err != nil {
+		message := fmt.Sprintf("Error encoding response as JSON: %s", err)
+		http.Error(w, message, http.StatusInternalServerError)
+		return
+	}
+}
+
+// getReadiness replies with the results of the readiness checks. If a check failed the status code is 503.
+func (h UserHandler) getReadiness(w http.ResponseWriter) {
+	response := h.Server.checkReadiness(time.Now())
+	if !response.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		message := fmt.Sprintf("Error encoding response as JSON: %s", err)
+		http.Error(w, message, http.StatusInternalServerError)
+		return
+	}
+}
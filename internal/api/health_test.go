@@ -0,0 +1,105 @@
+package api
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/fantostisch/wireguard-daemon/wgmanager"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// wgPeers returns the peers as WireGuard would report them after adding them.
+func wgPeers(peers []wgmanager.Peer) []wgtypes.Peer {
+	var wgPeers []wgtypes.Peer
+	for _, peer := range peers {
+		wgPeer := wgtypes.Peer{
+			PublicKey:                   peer.PublicKey.Key,
+			AllowedIPs:                  peer.AllowedIPs,
+			PersistentKeepaliveInterval: peer.PersistentKeepalive,
+		}
+		if peer.PresharedKey != nil {
+			wgPeer.PresharedKey = peer.PresharedKey.Key
+		}
+		wgPeers = append(wgPeers, wgPeer)
+	}
+	return wgPeers
+}
+
+func TestDiffPeers(t *testing.T) {
+	setup()
+	expected := server.expectedPeers(time.Now())
+	if diff := diffPeers(expected, wgPeers(expected)); !diff.empty() {
+		t.Errorf("Got differences for equal peers: %s", diff)
+	}
+
+	actual := wgPeers(expected)
+	// Allowed IPs in another order are equal.
+	actual[0].AllowedIPs = []net.IPNet{actual[0].AllowedIPs[1], actual[0].AllowedIPs[0]}
+	actual[1].PersistentKeepaliveInterval = 25 * time.Second
+	unexpectedKey, _ := wgtypes.GeneratePrivateKey()
+	actual = append(actual[:2], wgtypes.Peer{PublicKey: unexpectedKey})
+
+	diff := diffPeers(expected, actual)
+	if len(diff.missing) != 1 || diff.missing[0].PublicKey != expected[2].PublicKey {
+		t.Errorf("Unexpected missing peers: %v", diff.missing)
+	}
+	if len(diff.changed) != 1 || diff.changed[0].PublicKey != expected[1].PublicKey {
+		t.Errorf("Unexpected changed peers: %v", diff.changed)
+	}
+	if len(diff.unexpected) != 1 || diff.unexpected[0].Key != unexpectedKey {
+		t.Errorf("Unexpected unexpected peers: %v", diff.unexpected)
+	}
+	if diff.String() != "1 missing, 1 changed and 1 unexpected peers" {
+		t.Errorf("Unexpected description: %s", diff)
+	}
+}
+
+func TestHealthAndReadiness(t *testing.T) {
+	setup()
+	router := newAuthRouter()
+
+	// No credentials are needed.
+	respRec := httptest.NewRecorder()
+	router.ServeHTTP(respRec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	testHTTPStatus(t, *respRec, http.StatusOK)
+
+	storagePath := server.Storage.(*FileStorage).filePath
+	var tests = []struct {
+		name      string
+		peers     []wgtypes.Peer
+		filePath  string
+		expStatus int
+		expFailed []string
+	}{
+		{"ready", wgPeers(server.expectedPeers(time.Now())), storagePath, http.StatusOK, nil},
+		{"peers missing", nil, storagePath, http.StatusServiceUnavailable, []string{"peers"}},
+		{"storage not writable", wgPeers(server.expectedPeers(time.Now())), "/does/not/exist",
+			http.StatusServiceUnavailable, []string{"storage"}},
+	}
+
+	for _, test := range tests {
+		server.wgManager = TestWGManager{getPeersPeerList: test.peers}
+		server.Storage.(*FileStorage).filePath = test.filePath
+
+		respRec := httptest.NewRecorder()
+		router.ServeHTTP(respRec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		testHTTPStatus(t, *respRec, test.expStatus)
+
+		var got readinessResponse
+		if err := json.NewDecoder(respRec.Body).Decode(&got); err != nil {
+			t.Errorf("%s: error decoding JSON: %s", test.name, err)
+		}
+		if got.Ready != (test.expStatus == http.StatusOK) || len(got.Checks) != 3 {
+			t.Errorf("%s: unexpected response: %+v", test.name, got)
+		}
+		for _, name := range test.expFailed {
+			if got.Checks[name].OK || got.Checks[name].Error == "" {
+				t.Errorf("%s: check %s did not fail: %+v", test.name, name, got)
+			}
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package api
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"net"
+	"sync"
+)
+
+// ipAllocator hands out addresses from a range. Used addresses are kept in memory, so allocating and releasing an
+// address takes constant time instead of comparing every address in the range with every allocated address.
+// Addresses are stored as offset from the first address of the range. Released addresses are put on a free list and
+// handed out again before addresses which have never been used.
+type ipAllocator struct {
+	mutex   sync.Mutex
+	ipRange *net.IPNet
+	base    net.IP
+	size    uint64
+	used    map[uint64]struct{}
+	free    []uint64
+	// All offsets from next have never been handed out.
+	next uint64
+}
+
+const maxOffsetBytes = 8
+
+func newIPAllocator(ipRange *net.IPNet) *ipAllocator {
+	ones, bits := ipRange.Mask.Size()
+	hostBits := bits - ones
+	// Only the last 64 bits of large IPv6 ranges are used, which is more than enough.
+	size := uint64(math.MaxUint64)
+	if hostBits < 64 {
+		size = 1 << hostBits
+	}
+
+	base := ipRange.IP.Mask(ipRange.Mask)
+	if len(base) == net.IPv4len && size > 2 {
+		// The last address of an IPv4 range is the broadcast address.
+		size--
+	}
+	return &ipAllocator{
+		ipRange: ipRange,
+		base:    base,
+		size:    size,
+		used:    map[uint64]struct{}{},
+		// The first address of the range can not be used.
+		next: 1,
+	}
+}
+
+func (a *ipAllocator) normalize(ip net.IP) net.IP {
+	if len(a.base) == net.IPv4len {
+		return ip.To4()
+	}
+	return ip.To16()
+}
+
+// offset returns the offset of ip from the first address of the range and true if the address is in the range.
+func (a *ipAllocator) offset(ip net.IP) (uint64, bool) {
+	if !a.ipRange.Contains(ip) {
+		return 0, false
+	}
+	ip = a.normalize(ip)
+
+	prefixLength := 0
+	if len(ip) > maxOffsetBytes {
+		prefixLength = len(ip) - maxOffsetBytes
+	}
+	if !bytes.Equal(ip[:prefixLength], a.base[:prefixLength]) {
+		return 0, false
+	}
+	offset := toUint64(ip[prefixLength:]) - toUint64(a.base[prefixLength:])
+	return offset, offset < a.size
+}
+
+func (a *ipAllocator) ip(offset uint64) net.IP {
+	ip := make(net.IP, len(a.base))
+	copy(ip, a.base)
+
+	prefixLength := 0
+	if len(ip) > maxOffsetBytes {
+		prefixLength = len(ip) - maxOffsetBytes
+	}
+	value := toUint64(ip[prefixLength:]) + offset
+	buffer := make([]byte, maxOffsetBytes)
+	binary.BigEndian.PutUint64(buffer, value)
+	copy(ip[prefixLength:], buffer[maxOffsetBytes-(len(ip)-prefixLength):])
+	return ip
+}
+
+func toUint64(b []byte) uint64 {
+	buffer := make([]byte, maxOffsetBytes)
+	copy(buffer[maxOffsetBytes-len(b):], b)
+	return binary.BigEndian.Uint64(buffer)
+}
+
+// markUsed marks an address as used. Addresses outside the range are ignored.
+func (a *ipAllocator) markUsed(ip net.IP) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if offset, ok := a.offset(ip); ok {
+		a.used[offset] = struct{}{}
+	}
+}
+
+// allocate returns an unused address and marks it as used. Returns false if all addresses are used.
+func (a *ipAllocator) allocate() (net.IP, bool) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	for len(a.free) > 0 {
+		offset := a.free[len(a.free)-1]
+		a.free = a.free[:len(a.free)-1]
+		if _, used := a.used[offset]; !used {
+			a.used[offset] = struct{}{}
+			return a.ip(offset), true
+		}
+	}
+	for a.next < a.size {
+		offset := a.next
+		a.next++
+		if _, used := a.used[offset]; !used {
+			a.used[offset] = struct{}{}
+			return a.ip(offset), true
+		}
+	}
+	return nil, false
+}
+
+// release marks an address as unused. Addresses outside the range are ignored.
+func (a *ipAllocator) release(ip net.IP) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	offset, ok := a.offset(ip)
+	if !ok {
+		return
+	}
+	if _, used := a.used[offset]; used {
+		delete(a.used, offset)
+		a.free = append(a.free, offset)
+	}
+}
+
+// count returns the amount of used addresses and the amount of addresses which can still be allocated.
+func (a *ipAllocator) count() (uint64, uint64) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	used := uint64(len(a.used))
+	// The first address of the range can not be used.
+	return used, a.size - 1 - used
+}
@@ -0,0 +1,154 @@
+package api
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+func testAllocate(t *testing.T, allocator *ipAllocator, exp string) {
+	got, available := allocator.allocate()
+	if exp == "" {
+		if available {
+			t.Errorf("Got: %s, Wanted: no IP available", got)
+		}
+		return
+	}
+	if !available || !got.Equal(net.ParseIP(exp)) {
+		t.Errorf("Got: %s, Wanted: %s", got, exp)
+	}
+}
+
+func TestIPAllocatorIPv4(t *testing.T) {
+	_, ipRange, _ := net.ParseCIDR("10.0.0.0/29")
+	allocator := newIPAllocator(ipRange)
+	allocator.markUsed(net.ParseIP("10.0.0.1"))
+	allocator.markUsed(net.ParseIP("10.0.0.3"))
+	allocator.markUsed(net.ParseIP("10.0.1.3"))
+
+	if used, free := allocator.count(); used != 2 || free != 4 {
+		t.Errorf("Got %d used and %d free addresses, wanted 2 used and 4 free", used, free)
+	}
+	testAllocate(t, allocator, "10.0.0.2")
+	testAllocate(t, allocator, "10.0.0.4")
+
+	allocator.release(net.ParseIP("10.0.0.3"))
+	testAllocate(t, allocator, "10.0.0.3")
+
+	testAllocate(t, allocator, "10.0.0.5")
+	testAllocate(t, allocator, "10.0.0.6")
+	// The broadcast address is not handed out.
+	testAllocate(t, allocator, "")
+	if used, free := allocator.count(); used != 6 || free != 0 {
+		t.Errorf("Got %d used and %d free addresses, wanted 6 used and 0 free", used, free)
+	}
+
+	allocator.release(net.ParseIP("10.0.0.5"))
+	allocator.release(net.ParseIP("10.0.0.5"))
+	testAllocate(t, allocator, "10.0.0.5")
+	testAllocate(t, allocator, "")
+}
+
+func TestIPAllocatorIPv6(t *testing.T) {
+	_, ipRange, _ := net.ParseCIDR("fd00::/48")
+	allocator := newIPAllocator(ipRange)
+	allocator.markUsed(net.ParseIP("fd00::1"))
+	allocator.markUsed(net.ParseIP("fd00:0:0:1::2"))
+
+	testAllocate(t, allocator, "fd00::2")
+
+	allocator.markUsed(net.ParseIP("fd00::3"))
+	allocator.markUsed(net.ParseIP("10.0.0.4"))
+	testAllocate(t, allocator, "fd00::4")
+
+	_, ipRange, _ = net.ParseCIDR("fd00::ff00/120")
+	allocator = newIPAllocator(ipRange)
+	for i := 1; i <= 0xff; i++ {
+		testAllocate(t, allocator, fmt.Sprintf("fd00::ff%02x", i))
+	}
+	testAllocate(t, allocator, "")
+}
+
+const amountOfConfigs = 100000
+
+func BenchmarkIPAllocatorAllocate(b *testing.B) {
+	_, ipRange, _ := net.ParseCIDR("10.0.0.0/8")
+	allocator := newIPAllocator(ipRange)
+	for i := 0; i < amountOfConfigs; i++ {
+		allocator.allocate()
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ip, available := allocator.allocate()
+		if !available {
+			b.Fatal("No IP available")
+		}
+		allocator.release(ip)
+	}
+}
+
+func BenchmarkServerAllocateIPs(b *testing.B) {
+	addressPool, _ := ParseAddressPool("10.0.0.1/8", "fd00::1/64")
+	storage := &FileStorage{
+		filePath: filepath.Join(testStorageDir, "storage.json"),
+		data: data{
+			Users: map[UserID]*User{},
+		},
+	}
+	s := &Server{Storage: storage}
+	s.setAddressPools(map[string]AddressPool{DefaultPool: addressPool})
+
+	for i := 0; i < amountOfConfigs; i++ {
+		ip, ipv6, err := s.allocateIPs(DefaultPool)
+		if err != nil {
+			b.Fatal(err)
+		}
+		key, _ := TestWGManager{}.GeneratePrivateKey()
+		user := storage.getOrCreateUser(UserID(fmt.Sprint(i % 1000)))
+		user.Clients[key.PublicKey()] = NewClientConfig(ip, ipv6, DefaultPool)
+	}
+	// Rebuild the index from storage like on startup.
+	s.setAddressPools(map[string]AddressPool{DefaultPool: addressPool})
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ip, ipv6, err := s.allocateIPs(DefaultPool)
+		if err != nil {
+			b.Fatal(err)
+		}
+		s.releaseIPs(ClientConfig{IP: ip, IPv6: ipv6})
+	}
+}
+
+func BenchmarkNewConfig(b *testing.B) {
+	addressPool, _ := ParseAddressPool("10.0.0.1/8", "fd00::1/64")
+	storage := &FileStorage{
+		filePath: filepath.Join(testStorageDir, "storage.json"),
+		data: data{
+			Users: map[UserID]*User{},
+		},
+	}
+	s := &Server{Storage: storage, wgManager: TestWGManager{}}
+	s.setAddressPools(map[string]AddressPool{DefaultPool: addressPool})
+
+	for i := 0; i < amountOfConfigs; i++ {
+		ip, ipv6, err := s.allocateIPs(DefaultPool)
+		if err != nil {
+			b.Fatal(err)
+		}
+		key, _ := TestWGManager{}.GeneratePrivateKey()
+		user := storage.getOrCreateUser(UserID(fmt.Sprint(i % 1000)))
+		user.Clients[key.PublicKey()] = NewClientConfig(ip, ipv6, DefaultPool)
+	}
+	handler := UserHandler{Server: s}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		key, _ := TestWGManager{}.GeneratePrivateKey()
+		if _, err := handler.newConfig(UserID(fmt.Sprint(i%1000)), key.PublicKey(), createConfigOptions{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
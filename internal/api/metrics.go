@@ -0,0 +1,321 @@
+package api
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fantostisch/wireguard-daemon/wgmanager"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Metrics collects metrics of the daemon which are served in the Prometheus text format. Metrics which can be read
+// from storage or WireGuard are collected when they are requested.
+type Metrics struct {
+	mutex         sync.Mutex
+	requests      map[requestLabels]*histogram
+	storageWrites *histogram
+	// Amount of errors per WireGuard operation.
+	wgErrors map[string]uint64
+	// Amount of peers corrected by reconciliation per action.
+	reconciledPeers map[string]uint64
+}
+
+type requestLabels struct {
+	endpoint   string
+	statusCode int
+}
+
+// Upper bounds in seconds of the buckets of duration histograms.
+var durationBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// histogram counts observations in buckets like a Prometheus histogram.
+type histogram struct {
+	// Amount of observations less than or equal to the upper bound of the bucket in durationBuckets.
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+func newHistogram() *histogram {
+	return &histogram{buckets: make([]uint64, len(durationBuckets))}
+}
+
+func (h *histogram) observe(duration time.Duration) {
+	seconds := duration.Seconds()
+	for i, upperBound := range durationBuckets {
+		if seconds <= upperBound {
+			h.buckets[i]++
+		}
+	}
+	h.count++
+	h.sum += seconds
+}
+
+func newMetrics() *Metrics {
+	return &Metrics{
+		requests:      map[requestLabels]*histogram{},
+		storageWrites: newHistogram(),
+		wgErrors:      map[string]uint64{},
+
+		reconciledPeers: map[string]uint64{},
+	}
+}
+
+// observeRequest records an API request. Requests of unknown endpoints are recorded with endpoint "unknown" so
+// callers can not create an unlimited amount of metrics.
+func (m *Metrics) observeRequest(endpoint string, statusCode int, duration time.Duration) {
+	if _, exists := endpointScopes[endpoint]; !exists && !publicEndpoints[endpoint] {
+		endpoint = "unknown"
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	labels := requestLabels{endpoint: endpoint, statusCode: statusCode}
+	requests := m.requests[labels]
+	if requests == nil {
+		requests = newHistogram()
+		m.requests[labels] = requests
+	}
+	requests.observe(duration)
+}
+
+func (m *Metrics) observeStorageWrite(duration time.Duration) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.storageWrites.observe(duration)
+}
+
+func (m *Metrics) countWGError(operation string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.wgErrors[operation]++
+}
+
+func (m *Metrics) countReconciledPeers(action string, amount int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.reconciledPeers[action] += uint64(amount)
+}
+
+// statusRecorder remembers the status code of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	statusCode int
+}
+
+func (r *statusRecorder) WriteHeader(statusCode int) {
+	r.statusCode = statusCode
+	r.ResponseWriter.WriteHeader(statusCode)
+}
+
+// metricsWGManager counts the errors of WireGuard operations.
+type metricsWGManager struct {
+	wgmanager.IWGManager
+	metrics *Metrics
+}
+
+func (m metricsWGManager) count(operation string, err error) {
+	if err != nil {
+		m.metrics.countWGError(operation)
+	}
+}
+
+func (m metricsWGManager) GetPublicKey() (PublicKey, error) {
+	publicKey, err := m.IWGManager.GetPublicKey()
+	m.count("get_public_key", err)
+	return publicKey, err
+}
+
+func (m metricsWGManager) ConfigureWG(peers []wgmanager.Peer) error {
+	err := m.IWGManager.ConfigureWG(peers)
+	m.count("configure", err)
+	return err
+}
+
+func (m metricsWGManager) AddPeers(peers []wgmanager.Peer) error {
+	err := m.IWGManager.AddPeers(peers)
+	m.count("add_peers", err)
+	return err
+}
+
+func (m metricsWGManager) RemovePeers(publicKeys []PublicKey) error {
+	err := m.IWGManager.RemovePeers(publicKeys)
+	m.count("remove_peers", err)
+	return err
+}
+
+func (m metricsWGManager) GetConnections() ([]wgtypes.Peer, error) {
+	peers, err := m.IWGManager.GetConnections()
+	m.count("get_connections", err)
+	return peers, err
+}
+
+func (m metricsWGManager) GetPeers() ([]wgtypes.Peer, error) {
+	peers, err := m.IWGManager.GetPeers()
+	m.count("get_peers", err)
+	return peers, err
+}
+
+func (m metricsWGManager) GetInterfaceAddresses() ([]net.IPNet, error) {
+	addresses, err := m.IWGManager.GetInterfaceAddresses()
+	m.count("get_interface_addresses", err)
+	return addresses, err
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatLabels formats label names and values given as name, value, name, value, ...
+func formatLabels(namesAndValues ...string) string {
+	if len(namesAndValues) == 0 {
+		return ""
+	}
+	var labels []string
+	for i := 0; i+1 < len(namesAndValues); i += 2 {
+		value := labelValueEscaper.Replace(namesAndValues[i+1])
+		labels = append(labels, fmt.Sprintf(`%s="%s"`, namesAndValues[i], value))
+	}
+	return "{" + strings.Join(labels, ",") + "}"
+}
+
+func formatValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func writeMetricHeader(b *strings.Builder, name string, metricType string, help string) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+func writeSample(b *strings.Builder, name string, labels string, value float64) {
+	fmt.Fprintf(b, "%s%s %s\n", name, labels, formatValue(value))
+}
+
+// writeHistogram writes the samples of a histogram, labels are name, value pairs added to every sample.
+func writeHistogram(b *strings.Builder, name string, h *histogram, labels ...string) {
+	bucketLabels := func(upperBound string) string {
+		return formatLabels(append(append([]string{}, labels...), "le", upperBound)...)
+	}
+	for i, upperBound := range durationBuckets {
+		writeSample(b, name+"_bucket", bucketLabels(formatValue(upperBound)), float64(h.buckets[i]))
+	}
+	writeSample(b, name+"_bucket", bucketLabels("+Inf"), float64(h.count))
+	writeSample(b, name+"_sum", formatLabels(labels...), h.sum)
+	writeSample(b, name+"_count", formatLabels(labels...), float64(h.count))
+}
+
+// write writes the metrics collected by m.
+func (m *Metrics) write(b *strings.Builder) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var requestLabelList []requestLabels
+	for labels := range m.requests {
+		requestLabelList = append(requestLabelList, labels)
+	}
+	sort.Slice(requestLabelList, func(i, j int) bool {
+		if requestLabelList[i].endpoint != requestLabelList[j].endpoint {
+			return requestLabelList[i].endpoint < requestLabelList[j].endpoint
+		}
+		return requestLabelList[i].statusCode < requestLabelList[j].statusCode
+	})
+
+	writeMetricHeader(b, "wireguard_daemon_api_requests_total", "counter", "Amount of API requests.")
+	for _, labels := range requestLabelList {
+		writeSample(b, "wireguard_daemon_api_requests_total",
+			formatLabels("endpoint", labels.endpoint, "status", strconv.Itoa(labels.statusCode)),
+			float64(m.requests[labels].count))
+	}
+	writeMetricHeader(b, "wireguard_daemon_api_request_duration_seconds", "histogram",
+		"Time it took to handle API requests.")
+	for _, labels := range requestLabelList {
+		writeHistogram(b, "wireguard_daemon_api_request_duration_seconds", m.requests[labels],
+			"endpoint", labels.endpoint, "status", strconv.Itoa(labels.statusCode))
+	}
+
+	writeMetricHeader(b, "wireguard_daemon_storage_write_duration_seconds", "histogram",
+		"Time it took to write changes to storage.")
+	writeHistogram(b, "wireguard_daemon_storage_write_duration_seconds", m.storageWrites)
+
+	var operations []string
+	for operation := range m.wgErrors {
+		operations = append(operations, operation)
+	}
+	sort.Strings(operations)
+	writeMetricHeader(b, "wireguard_daemon_wireguard_errors_total", "counter",
+		"Amount of errors of WireGuard operations.")
+	for _, operation := range operations {
+		writeSample(b, "wireguard_daemon_wireguard_errors_total", formatLabels("operation", operation),
+			float64(m.wgErrors[operation]))
+	}
+
+	var actions []string
+	for action := range m.reconciledPeers {
+		actions = append(actions, action)
+	}
+	sort.Strings(actions)
+	writeMetricHeader(b, "wireguard_daemon_reconciled_peers_total", "counter",
+		"Amount of peers corrected by reconciliation of WireGuard with storage.")
+	for _, action := range actions {
+		writeSample(b, "wireguard_daemon_reconciled_peers_total", formatLabels("action", action),
+			float64(m.reconciledPeers[action]))
+	}
+}
+
+// writeMetrics writes all metrics in the Prometheus text format.
+func (s *Server) writeMetrics(b *strings.Builder) {
+	users := s.Storage.GetAllUsers()
+	enabledUsers := 0
+	configs := 0
+	for _, user := range users {
+		if !user.IsDisabled {
+			enabledUsers++
+		}
+		configs += len(user.Clients)
+	}
+	writeMetricHeader(b, "wireguard_daemon_users", "gauge", "Amount of users.")
+	writeSample(b, "wireguard_daemon_users", "", float64(len(users)))
+	writeMetricHeader(b, "wireguard_daemon_enabled_users", "gauge", "Amount of enabled users.")
+	writeSample(b, "wireguard_daemon_enabled_users", "", float64(enabledUsers))
+	writeMetricHeader(b, "wireguard_daemon_configs", "gauge", "Amount of configs of all users.")
+	writeSample(b, "wireguard_daemon_configs", "", float64(configs))
+
+	// If WireGuard can not be reached the error is counted and the metric is left out.
+	if connections, err := s.wgManager.GetConnections(); err == nil {
+		writeMetricHeader(b, "wireguard_daemon_connected_peers", "gauge",
+			"Amount of peers which performed a handshake in the last 3 minutes.")
+		writeSample(b, "wireguard_daemon_connected_peers", "", float64(len(connections)))
+	}
+
+	var pools []string
+	for name := range s.allocators {
+		pools = append(pools, name)
+	}
+	sort.Strings(pools)
+	writeMetricHeader(b, "wireguard_daemon_pool_addresses", "gauge",
+		"Amount of used and free addresses of address pools, including the address of the server.")
+	for _, name := range pools {
+		allocator := s.allocators[name]
+		for _, family := range []struct {
+			name      string
+			allocator *ipAllocator
+		}{{"ipv4", allocator.ipv4}, {"ipv6", allocator.ipv6}} {
+			used, free := family.allocator.count()
+			writeSample(b, "wireguard_daemon_pool_addresses",
+				formatLabels("pool", name, "family", family.name, "state", "used"), float64(used))
+			writeSample(b, "wireguard_daemon_pool_addresses",
+				formatLabels("pool", name, "family", family.name, "state", "free"), float64(free))
+		}
+	}
+
+	if s.metrics != nil {
+		s.metrics.write(b)
+	}
+}
@@ -0,0 +1,104 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestMetrics(t *testing.T) {
+	setup()
+	server.metrics = newMetrics()
+	server.wgManager = metricsWGManager{
+		IWGManager: TestWGManager{
+			configureWG:            errors.New("oops"),
+			getConnectionsPeerList: []wgtypes.Peer{{}, {}},
+		},
+		metrics: server.metrics,
+	}
+	server.Storage.(WriteObserver).SetWriteObserver(server.metrics.observeStorageWrite)
+	router := API{
+		UserHandler: UserHandler{Server: server},
+		Metrics:     server.metrics,
+	}
+
+	// Disabling the user fails because WireGuard returns an error.
+	parameters := url.Values{"user_id": {peterUsername}}
+	req, _ := http.NewRequest(http.MethodPost, "/disable_user?"+parameters.Encode(), nil)
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+	req, _ = http.NewRequest(http.MethodGet, "/configs?"+parameters.Encode(), nil)
+	router.ServeHTTP(httptest.NewRecorder(), req)
+	req, _ = http.NewRequest(http.MethodGet, "/does_not_exist", nil)
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	req, _ = http.NewRequest(http.MethodGet, "/metrics", nil)
+	respRec := httptest.NewRecorder()
+	router.ServeHTTP(respRec, req)
+	testHTTPStatus(t, *respRec, http.StatusOK)
+
+	got := respRec.Body.String()
+	for _, exp := range []string{
+		"# TYPE wireguard_daemon_users gauge\nwireguard_daemon_users 1\n",
+		"wireguard_daemon_enabled_users 0\n",
+		"wireguard_daemon_configs 3\n",
+		"wireguard_daemon_connected_peers 2\n",
+		`wireguard_daemon_pool_addresses{pool="default",family="ipv4",state="used"} 3` + "\n",
+		`wireguard_daemon_pool_addresses{pool="default",family="ipv4",state="free"} 1.6777211e+07` + "\n",
+		`wireguard_daemon_api_requests_total{endpoint="configs",status="200"} 1` + "\n",
+		`wireguard_daemon_api_requests_total{endpoint="disable_user",status="500"} 1` + "\n",
+		`wireguard_daemon_api_requests_total{endpoint="unknown",status="404"} 1` + "\n",
+		`wireguard_daemon_api_request_duration_seconds_bucket{endpoint="configs",status="200",le="+Inf"} 1` + "\n",
+		`wireguard_daemon_api_request_duration_seconds_count{endpoint="configs",status="200"} 1` + "\n",
+		`wireguard_daemon_storage_write_duration_seconds_count 1` + "\n",
+		`wireguard_daemon_wireguard_errors_total{operation="remove_peers"} 1` + "\n",
+	} {
+		if !strings.Contains(got, exp) {
+			t.Errorf("Metrics do not contain %q:\n%s", exp, got)
+		}
+	}
+}
+
+func TestWireGuardErrorMetrics(t *testing.T) {
+	err := errors.New("oops")
+	m := metricsWGManager{
+		IWGManager: TestWGManager{getConnectionsError: err},
+		metrics:    newMetrics(),
+	}
+	_, _ = m.GetConnections()
+	_, _ = m.GetConnections()
+
+	exp := map[string]uint64{"get_connections": 2}
+	if !reflect.DeepEqual(m.metrics.wgErrors, exp) {
+		t.Errorf("Got errors %v, expected %v", m.metrics.wgErrors, exp)
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	h := newHistogram()
+	h.observe(3 * time.Millisecond)
+	h.observe(2 * time.Second)
+	h.observe(time.Minute)
+
+	var b strings.Builder
+	writeHistogram(&b, "test", h, "endpoint", `a"b`)
+	for _, exp := range []string{
+		`test_bucket{endpoint="a\"b",le="0.001"} 0` + "\n",
+		`test_bucket{endpoint="a\"b",le="0.005"} 1` + "\n",
+		`test_bucket{endpoint="a\"b",le="2.5"} 2` + "\n",
+		`test_bucket{endpoint="a\"b",le="10"} 2` + "\n",
+		`test_bucket{endpoint="a\"b",le="+Inf"} 3` + "\n",
+		`test_count{endpoint="a\"b"} 3` + "\n",
+	} {
+		if !strings.Contains(b.String(), exp) {
+			t.Errorf("Histogram does not contain %q:\n%s", exp, b.String())
+		}
+	}
+}
@@ -9,37 +9,163 @@ import (
 
 type PublicKey = wgmanager.PublicKey
 type PrivateKey = wgmanager.PrivateKey
+type PresharedKey = wgmanager.PresharedKey
 
 type UserID string
 
 type User struct {
 	IsDisabled bool                       `json:"isDisabled"`
 	Clients    map[PublicKey]ClientConfig `json:"clients"`
+	// Pool used for new configs if no pool is chosen. If empty DefaultPool is used.
+	Pool string `json:"pool,omitempty"`
+	// Maximum amount of configs of the user, overrides the default of the server. 0 means unlimited.
+	MaxConfigs *int `json:"maxConfigs,omitempty"`
+	// Why the user is disabled. Users disabled before reasons were stored have no reason, they were disabled by an
+	// admin.
+	DisabledReason DisabledReason `json:"disabledReason,omitempty"`
+	// Maximum amount of bytes the user can receive and transmit per month, overrides the default of the server. 0
+	// means unlimited.
+	MonthlyQuota *int64 `json:"monthlyQuota,omitempty"`
+}
+
+// DisabledReason is the reason a user is disabled.
+type DisabledReason string
+
+const (
+	// NotDisabled is the reason of users which are enabled.
+	NotDisabled DisabledReason = ""
+	// DisabledByAdmin is the reason of users disabled using the API.
+	DisabledByAdmin DisabledReason = "admin"
+	// DisabledQuotaExceeded is the reason of users which used more traffic than their monthly quota. They are enabled
+	// automatically when the next month starts.
+	DisabledQuotaExceeded DisabledReason = "quota_exceeded"
+)
+
+// disabledReason returns the reason the user is disabled, NotDisabled if the user is enabled.
+func (u User) disabledReason() DisabledReason {
+	if !u.IsDisabled {
+		return NotDisabled
+	}
+	if u.DisabledReason == NotDisabled {
+		return DisabledByAdmin
+	}
+	return u.DisabledReason
 }
 
 type ClientConfig struct {
 	IP       net.IP `json:"ip"`
+	IPv6     net.IP `json:"ipv6"`
+	Pool     string `json:"pool,omitempty"`
 	Modified TimeJ  `json:"modified"`
+	// PresharedKey is a secret and is only returned to API callers when it is created.
+	PresharedKey *PresharedKey `json:"presharedKey,omitempty"`
+	// Networks routed to the client in addition to its addresses, e.g. networks behind a router.
+	AllowedIPs []Subnet `json:"allowedIPs,omitempty"`
+	// Interval in seconds in which the server sends keepalive packets to the client, 0 means disabled.
+	PersistentKeepalive int `json:"persistentKeepalive,omitempty"`
+	// Time after which the config can no longer be used, nil if the config does not expire.
+	Expires *TimeJ `json:"expires,omitempty"`
+	// Expired is set when the config is expired and the server is configured to keep expired configs.
+	Expired bool `json:"expired,omitempty"`
+	// Name to recognize the config by, e.g. the name of the device.
+	Name string `json:"name,omitempty"`
+	// Free-form information about the config, e.g. the type of device.
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// Subnet is a network which is encoded in CIDR notation.
+type Subnet struct {
+	net.IPNet
+}
+
+func ParseSubnet(s string) (Subnet, error) {
+	_, ipNet, err := net.ParseCIDR(s)
+	if err != nil {
+		return Subnet{}, err
+	}
+	return Subnet{*ipNet}, nil
+}
+
+func (s *Subnet) UnmarshalText(data []byte) error {
+	subnet, err := ParseSubnet(string(data))
+	if err != nil {
+		return err
+	}
+	*s = subnet
+	return nil
+}
+
+func (s Subnet) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
 }
 
-func NewClientConfig(ip net.IP) ClientConfig {
+func NewClientConfig(ip net.IP, ipv6 net.IP, pool string) ClientConfig {
 	now := TimeJ{time.Now().UTC()}
 	config := ClientConfig{
 		IP:       ip,
+		IPv6:     ipv6,
+		Pool:     pool,
 		Modified: now,
 	}
 	return config
 }
 
+// isExpired returns if the config can no longer be used at time now.
+func (c ClientConfig) isExpired(now time.Time) bool {
+	return c.Expired || (c.Expires != nil && !now.Before(c.Expires.Time))
+}
+
+// withoutSecrets returns a copy of the configs without their preshared keys, to be used in API responses.
+func withoutSecrets(clients map[PublicKey]ClientConfig) map[PublicKey]ClientConfig {
+	result := map[PublicKey]ClientConfig{}
+	for publicKey, config := range clients {
+		config.PresharedKey = nil
+		result[publicKey] = config
+	}
+	return result
+}
+
+// IPs returns all addresses assigned to the client. Configs created before IPv6 support was added do not have an IPv6
+// address.
+func (c ClientConfig) IPs() []net.IP {
+	var ips []net.IP
+	if c.IP != nil {
+		ips = append(ips, c.IP)
+	}
+	if c.IPv6 != nil {
+		ips = append(ips, c.IPv6)
+	}
+	return ips
+}
+
+// ipToIPNet returns a network containing only ip.
+func ipToIPNet(ip net.IP) net.IPNet {
+	const amountOfBitsInIPv4Address = 32
+	const amountOfBitsInIPv6Address = 128
+
+	bits := amountOfBitsInIPv6Address
+	if ip.To4() != nil {
+		ip = ip.To4()
+		bits = amountOfBitsInIPv4Address
+	}
+	return net.IPNet{
+		IP:   ip,
+		Mask: net.CIDRMask(bits, bits),
+	}
+}
+
 func ClientToWGPeer(publicKey PublicKey, client ClientConfig) wgmanager.Peer {
-	allowedIPs := make([]net.IPNet, 1)
-	amountOfBitsInIPv4Address := 32
-	allowedIPs[0] = net.IPNet{
-		IP:   client.IP,
-		Mask: net.CIDRMask(amountOfBitsInIPv4Address, amountOfBitsInIPv4Address),
+	var allowedIPs []net.IPNet
+	for _, ip := range client.IPs() {
+		allowedIPs = append(allowedIPs, ipToIPNet(ip))
+	}
+	for _, subnet := range client.AllowedIPs {
+		allowedIPs = append(allowedIPs, subnet.IPNet)
 	}
 	return wgmanager.Peer{
-		PublicKey:  publicKey,
-		AllowedIPs: allowedIPs,
+		PublicKey:           publicKey,
+		AllowedIPs:          allowedIPs,
+		PresharedKey:        client.PresharedKey,
+		PersistentKeepalive: time.Duration(client.PersistentKeepalive) * time.Second,
 	}
 }
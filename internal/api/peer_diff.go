@@ -0,0 +1,98 @@
+package api
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/fantostisch/wireguard-daemon/wgmanager"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// peerDiff contains the differences between the peers which should be in WireGuard according to storage and the
+// peers in WireGuard.
+type peerDiff struct {
+	// Peers missing from WireGuard.
+	missing []wgmanager.Peer
+	// Peers in WireGuard with other settings than in storage.
+	changed []wgmanager.Peer
+	// Peers in WireGuard without an active config.
+	unexpected []PublicKey
+}
+
+func (d peerDiff) empty() bool {
+	return len(d.missing) == 0 && len(d.changed) == 0 && len(d.unexpected) == 0
+}
+
+func (d peerDiff) String() string {
+	return fmt.Sprintf("%d missing, %d changed and %d unexpected peers", len(d.missing), len(d.changed),
+		len(d.unexpected))
+}
+
+// expectedPeers returns the peers which should be in WireGuard: the configs of enabled users which are not expired.
+func (s *Server) expectedPeers(now time.Time) []wgmanager.Peer {
+	var wgPeers []wgmanager.Peer
+	for _, user := range s.Storage.GetEnabledUsers() {
+		for publicKey, config := range user.Clients {
+			if !config.isExpired(now) {
+				wgPeers = append(wgPeers, ClientToWGPeer(publicKey, config))
+			}
+		}
+	}
+	return wgPeers
+}
+
+// diffPeers compares the expected peers with the peers in WireGuard.
+func diffPeers(expected []wgmanager.Peer, actual []wgtypes.Peer) peerDiff {
+	actualPeers := map[PublicKey]wgtypes.Peer{}
+	for _, peer := range actual {
+		actualPeers[PublicKey{peer.PublicKey}] = peer
+	}
+
+	diff := peerDiff{}
+	for _, peer := range expected {
+		actualPeer, exists := actualPeers[peer.PublicKey]
+		if !exists {
+			diff.missing = append(diff.missing, peer)
+			continue
+		}
+		delete(actualPeers, peer.PublicKey)
+		if !peerEqual(peer, actualPeer) {
+			diff.changed = append(diff.changed, peer)
+		}
+	}
+	for publicKey := range actualPeers {
+		diff.unexpected = append(diff.unexpected, publicKey)
+	}
+	return diff
+}
+
+// peerEqual returns if a peer in WireGuard has the settings of peer.
+func peerEqual(peer wgmanager.Peer, actual wgtypes.Peer) bool {
+	presharedKey := wgtypes.Key{}
+	if peer.PresharedKey != nil {
+		presharedKey = peer.PresharedKey.Key
+	}
+	if actual.PresharedKey != presharedKey || actual.PersistentKeepaliveInterval != peer.PersistentKeepalive {
+		return false
+	}
+	if len(actual.AllowedIPs) != len(peer.AllowedIPs) {
+		return false
+	}
+	var expectedIPs []string
+	for i := range peer.AllowedIPs {
+		expectedIPs = append(expectedIPs, peer.AllowedIPs[i].String())
+	}
+	var actualIPs []string
+	for i := range actual.AllowedIPs {
+		actualIPs = append(actualIPs, actual.AllowedIPs[i].String())
+	}
+	sort.Strings(expectedIPs)
+	sort.Strings(actualIPs)
+	for i := range expectedIPs {
+		if expectedIPs[i] != actualIPs[i] {
+			return false
+		}
+	}
+	return true
+}
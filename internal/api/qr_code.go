@@ -0,0 +1,66 @@
+package api
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/skip2/go-qrcode"
+)
+
+// QRCodeFormat is the image format of a QR code.
+type QRCodeFormat string
+
+const (
+	QRCodePNG  QRCodeFormat = "png"
+	QRCodeSVG  QRCodeFormat = "svg"
+	QRCodeText QRCodeFormat = "text"
+)
+
+var qrCodeContentTypes = map[QRCodeFormat]string{
+	QRCodePNG:  "image/png",
+	QRCodeSVG:  "image/svg+xml",
+	QRCodeText: "text/plain; charset=utf-8",
+}
+
+// Width and height of PNG QR codes in pixels.
+const qrCodePNGSize = 512
+
+// renderQRCode returns a QR code containing content. The text format uses unicode block characters and can be printed
+// in a terminal.
+func renderQRCode(content string, format QRCodeFormat) ([]byte, error) {
+	qrCode, err := qrcode.New(content, qrcode.Medium)
+	if err != nil {
+		return nil, err
+	}
+
+	switch format {
+	case QRCodePNG:
+		return qrCode.PNG(qrCodePNGSize)
+	case QRCodeSVG:
+		return renderQRCodeSVG(qrCode.Bitmap()), nil
+	case QRCodeText:
+		return []byte(qrCode.ToSmallString(false)), nil
+	default:
+		return nil, fmt.Errorf("unknown QR code format '%s'", format)
+	}
+}
+
+// renderQRCodeSVG returns an SVG image of a QR code in which every module is one unit.
+func renderQRCodeSVG(bitmap [][]bool) []byte {
+	var path strings.Builder
+	for y, row := range bitmap {
+		for x, dark := range row {
+			if dark {
+				fmt.Fprintf(&path, "M%d,%dh1v1h-1z", x, y)
+			}
+		}
+	}
+
+	size := len(bitmap)
+	return []byte(fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" shape-rendering="crispEdges">
+<rect width="%d" height="%d" fill="#ffffff"/>
+<path d="%s" fill="#000000"/>
+</svg>
+`, size, size, size, size, path.String()))
+}
@@ -0,0 +1,93 @@
+package api
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestRenderQRCodeSVG(t *testing.T) {
+	got := string(renderQRCodeSVG([][]bool{
+		{true, false},
+		{false, true},
+	}))
+	if !strings.Contains(got, `viewBox="0 0 2 2"`) {
+		t.Errorf("SVG does not have the size of the QR code:\n%s", got)
+	}
+	if !strings.Contains(got, `<path d="M0,0h1v1h-1zM1,1h1v1h-1z"`) {
+		t.Errorf("SVG does not contain the dark modules:\n%s", got)
+	}
+}
+
+func testGetClientConfigQRCode(t *testing.T, privateKey string, format string,
+	apiError *Error) *httptest.ResponseRecorder {
+
+	requestBody := url.Values{
+		"user_id":     {peterUsername},
+		"public_key":  {petersPublicKey1String},
+		"private_key": {privateKey},
+		"format":      {format},
+	}
+	req, _ := http.NewRequest(http.MethodPost, "/client_config_qr", bytes.NewBufferString(requestBody.Encode()))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+
+	respRec := httptest.NewRecorder()
+	apiRouter.ServeHTTP(respRec, req)
+
+	testError(t, *respRec, apiError)
+	return respRec
+}
+
+func TestGetClientConfigQRCode(t *testing.T) {
+	setup()
+	setupClientConfigTemplate()
+	testGetClientConfigQRCode(t, "", "", &MissingPostParameter)
+
+	privateKey, _ := TestWGManager{}.GeneratePrivateKey()
+	testGetClientConfigQRCode(t, privateKey.String(), "", &InvalidPrivateKey)
+
+	testCreateConfig(t, peterUsername, privateKey.PublicKey().String(), nil)
+	requestBody := func(format string) url.Values {
+		return url.Values{
+			"user_id":     {peterUsername},
+			"public_key":  {privateKey.PublicKey().String()},
+			"private_key": {privateKey.String()},
+			"format":      {format},
+		}
+	}
+
+	var tests = []struct {
+		format      string
+		contentType string
+		prefix      string
+		apiError    *Error
+	}{
+		{"", "image/png", "\x89PNG", nil},
+		{"png", "image/png", "\x89PNG", nil},
+		{"svg", "image/svg+xml", "<?xml", nil},
+		{"text", "text/plain; charset=utf-8", "█", nil},
+		{"jpeg", "", "", &InvalidQRCodeFormat},
+	}
+
+	for _, test := range tests {
+		req, _ := http.NewRequest(http.MethodPost, "/client_config_qr",
+			bytes.NewBufferString(requestBody(test.format).Encode()))
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		respRec := httptest.NewRecorder()
+		apiRouter.ServeHTTP(respRec, req)
+
+		testError(t, *respRec, test.apiError)
+		if test.apiError != nil {
+			continue
+		}
+		if got := respRec.Header().Get("Content-Type"); got != test.contentType {
+			t.Errorf("Format %s: Got content type: %s, Wanted: %s", test.format, got, test.contentType)
+		}
+		if !strings.HasPrefix(respRec.Body.String(), test.prefix) {
+			t.Errorf("Format %s: Response does not start with %q", test.format, test.prefix)
+		}
+	}
+}
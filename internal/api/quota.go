@@ -0,0 +1,81 @@
+package api
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// QuotaStatus contains the traffic of a user in the current period of the monthly quota. Periods are calendar months
+// in UTC.
+type QuotaStatus struct {
+	// Maximum amount of bytes the user can receive and transmit in a period, 0 means unlimited.
+	MonthlyQuota int64 `json:"monthlyQuota"`
+	// Amount of bytes received and transmitted in the current period.
+	Used        int64 `json:"used"`
+	PeriodStart TimeJ `json:"periodStart"`
+	PeriodEnd   TimeJ `json:"periodEnd"`
+	Exceeded    bool  `json:"exceeded"`
+	// Why the user is disabled, empty if the user is enabled.
+	DisabledReason DisabledReason `json:"disabledReason"`
+}
+
+// quotaPeriod returns the start and the end of the month containing now in UTC.
+func quotaPeriod(now time.Time) (time.Time, time.Time) {
+	now = now.UTC()
+	start := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	return start, start.AddDate(0, 1, 0)
+}
+
+// getMonthlyQuota returns the monthly quota of a user in bytes, 0 means unlimited.
+func (s *Server) getMonthlyQuota(username UserID) int64 {
+	if monthlyQuota := s.Storage.GetMonthlyQuota(username); monthlyQuota != nil {
+		return *monthlyQuota
+	}
+	return s.monthlyQuota
+}
+
+func (s *Server) getQuotaStatus(username UserID, now time.Time) QuotaStatus {
+	start, end := quotaPeriod(now)
+	status := QuotaStatus{
+		MonthlyQuota:   s.getMonthlyQuota(username),
+		PeriodStart:    TimeJ{start},
+		PeriodEnd:      TimeJ{end},
+		DisabledReason: s.Storage.GetDisabledReason(username),
+	}
+	if s.usage != nil {
+		usage := s.usage.GetUserUsageSince(username, start)
+		status.Used = usage.ReceiveBytes + usage.TransmitBytes
+	}
+	status.Exceeded = status.MonthlyQuota > 0 && status.Used >= status.MonthlyQuota
+	return status
+}
+
+// enforceQuota disables a user which exceeded its quota and enables a user which was disabled because of its quota but
+// did not exceed the quota anymore, because a new period started or the quota was raised.
+func (s *Server) enforceQuota(username UserID, now time.Time) error {
+	status := s.getQuotaStatus(username, now)
+	switch {
+	case status.Exceeded && status.DisabledReason == NotDisabled:
+		if _, err := s.disableUser(username, DisabledQuotaExceeded); err != nil {
+			return fmt.Errorf("error disabling user %s: %w", username, err)
+		}
+		log.Printf("User %s exceeded the monthly quota and is disabled", username)
+	case !status.Exceeded && status.DisabledReason == DisabledQuotaExceeded:
+		if _, err := s.enableUser(username); err != nil {
+			return fmt.Errorf("error enabling user %s: %w", username, err)
+		}
+		log.Printf("User %s is within the monthly quota again and is enabled", username)
+	}
+	return nil
+}
+
+// enforceQuotas enforces the quotas of all users, errors are logged so one user can not prevent enforcing the quotas of
+// other users.
+func (s *Server) enforceQuotas(now time.Time) {
+	for username := range s.Storage.GetAllUsers() {
+		if err := s.enforceQuota(username, now); err != nil {
+			log.Print("Error enforcing quota: ", err)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/fantostisch/wireguard-daemon/wgmanager"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func testSetMonthlyQuota(t *testing.T, username string, quota string, apiError *Error) {
+	parameters := url.Values{
+		"user_id": {username},
+		"quota":   {quota},
+	}
+	req, _ := http.NewRequest(http.MethodPost, "/set_monthly_quota?"+parameters.Encode(), nil)
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	respRec := httptest.NewRecorder()
+	apiRouter.ServeHTTP(respRec, req)
+	testError(t, *respRec, apiError)
+}
+
+func testDisabledReason(t *testing.T, username UserID, exp DisabledReason) {
+	if got := server.Storage.GetDisabledReason(username); got != exp {
+		t.Errorf("Disabled reason '%s' is not the expected '%s'", got, exp)
+	}
+}
+
+func TestMonthlyQuota(t *testing.T) {
+	setup()
+	petersPublicKey1, _ := wgtypes.ParseKey(petersPublicKey1String)
+	publicKey1 := PublicKey{petersPublicKey1}
+	now := time.Now()
+	nextMonth := now.AddDate(0, 1, 0)
+
+	parameters := url.Values{"user_id": {peterUsername}}
+	req, _ := http.NewRequest(http.MethodGet, "/quota?"+parameters.Encode(), nil)
+	respRec := httptest.NewRecorder()
+	apiRouter.ServeHTTP(respRec, req)
+	testError(t, *respRec, &UsageUnavailable)
+
+	server.usage = newTestUsageStorage()
+	if err := server.usage.record([]usageSample{{peterUsername, publicKey1, Usage{500, 100}}}, now); err != nil {
+		t.Fatalf("Error recording usage: %s", err)
+	}
+
+	testSetMonthlyQuota(t, peterUsername, "1000", nil)
+	testDisabledReason(t, peterUsername, NotDisabled)
+
+	respRec = httptest.NewRecorder()
+	apiRouter.ServeHTTP(respRec, req)
+	testError(t, *respRec, nil)
+	var got struct {
+		MonthlyQuota int64 `json:"monthlyQuota"`
+		Used         int64 `json:"used"`
+		Exceeded     bool  `json:"exceeded"`
+	}
+	if err := json.NewDecoder(respRec.Body).Decode(&got); err != nil {
+		t.Errorf("Error decoding JSON: %s", err)
+	}
+	if got.MonthlyQuota != 1000 || got.Used != 600 || got.Exceeded {
+		t.Errorf("Unexpected quota status: %+v", got)
+	}
+
+	// Exceeding the quota disables the user until the next month.
+	if err := server.usage.record([]usageSample{{peterUsername, publicKey1, Usage{900, 200}}}, now); err != nil {
+		t.Fatalf("Error recording usage: %s", err)
+	}
+	server.enforceQuotas(now)
+	testDisabledReason(t, peterUsername, DisabledQuotaExceeded)
+	server.enforceQuotas(nextMonth)
+	testDisabledReason(t, peterUsername, NotDisabled)
+
+	// Raising the quota enables the user immediately.
+	server.enforceQuotas(now)
+	testDisabledReason(t, peterUsername, DisabledQuotaExceeded)
+	testSetMonthlyQuota(t, peterUsername, "2000", nil)
+	testDisabledReason(t, peterUsername, NotDisabled)
+	testSetMonthlyQuota(t, peterUsername, "1000", nil)
+	testDisabledReason(t, peterUsername, DisabledQuotaExceeded)
+
+	// A user disabled by an admin is not enabled automatically.
+	testDisableUser(t, peterUsername, nil)
+	testDisabledReason(t, peterUsername, DisabledByAdmin)
+	testDisableUser(t, peterUsername, &UserAlreadyDisabled)
+	server.enforceQuotas(nextMonth)
+	testDisabledReason(t, peterUsername, DisabledByAdmin)
+
+	testSetMonthlyQuota(t, peterUsername, "-1", &InvalidQuota)
+	testSetMonthlyQuota(t, peterUsername, "1GB", &InvalidQuota)
+	testSetMonthlyQuota(t, peterUsername, "default", nil)
+	if quota := server.getMonthlyQuota(peterUsername); quota != 0 {
+		t.Errorf("Quota %d is not the default quota", quota)
+	}
+}
+
+func TestCreateConfigOfQuotaDisabledUser(t *testing.T) {
+	setup()
+	var added []wgmanager.Peer
+	var removed []PublicKey
+	server.wgManager = recordingWGManager{added: &added, removed: &removed}
+	if _, err := server.Storage.SetDisabled(peterUsername, DisabledQuotaExceeded); err != nil {
+		t.Fatalf("Error disabling user: %s", err)
+	}
+
+	// The config is saved but does not give access until the user is enabled.
+	publicKeyString := "la7/0uhQGn99wdqimEPvfmLOl4u9BUlx5BhLpZLw0QA="
+	testCreateConfig(t, peterUsername, publicKeyString, nil)
+	if len(added) != 0 {
+		t.Errorf("Peers of disabled user added to WireGuard: %v", added)
+	}
+	key, _ := wgtypes.ParseKey(publicKeyString)
+	if _, exists := server.Storage.GetUserClients(peterUsername)[PublicKey{key}]; !exists {
+		t.Error("Config was not saved")
+	}
+
+	// Disabled users can not claim addresses which would be released.
+	server.disabledUserIPPolicy = ReleaseIPs
+	testCreateConfig(t, peterUsername, "RuvRcz3zuwz/3xMqqh2ZvL+NT3W2v6J60rMnHtRiOE8=", &UserDisabled)
+	if len(added) != 0 {
+		t.Errorf("Peers of disabled user added to WireGuard: %v", added)
+	}
+}
@@ -0,0 +1,91 @@
+package api
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/fantostisch/wireguard-daemon/wgmanager"
+)
+
+// UnexpectedPeerPolicy determines what happens with peers in WireGuard which do not belong to an active config.
+type UnexpectedPeerPolicy string
+
+const (
+	// RemoveUnexpectedPeers removes unexpected peers from WireGuard.
+	RemoveUnexpectedPeers UnexpectedPeerPolicy = "remove"
+	// ReportUnexpectedPeers only logs unexpected peers.
+	ReportUnexpectedPeers UnexpectedPeerPolicy = "report"
+)
+
+func (s *Server) reconcilePeersPeriodically() {
+	ticker := time.NewTicker(s.reconcileInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case now := <-ticker.C:
+			if err := s.reconcilePeers(now); err != nil {
+				log.Print("Error reconciling WireGuard peers: ", err)
+			}
+		}
+	}
+}
+
+// reconcilePeers makes the peers in WireGuard match the active configs in storage, for example after peers were
+// changed using wg or the interface was recreated. Missing peers are added, peers with other settings are updated and
+// unexpected peers are removed or reported depending on the policy. Every correction is logged.
+func (s *Server) reconcilePeers(now time.Time) error {
+	// The peers in WireGuard are read before storage, so a config created in between is not seen as unexpected.
+	peers, err := s.wgManager.GetPeers()
+	if err != nil {
+		return fmt.Errorf("error getting WireGuard peers: %w", err)
+	}
+	diff := diffPeers(s.expectedPeers(now), peers)
+	if diff.empty() {
+		return nil
+	}
+	usernames := s.Storage.GetUsernames()
+
+	for _, peer := range diff.missing {
+		log.Printf("Adding config %s of user %s missing from WireGuard", peer.PublicKey, usernames[peer.PublicKey])
+	}
+	for _, peer := range diff.changed {
+		log.Printf("Updating config %s of user %s with other settings in WireGuard", peer.PublicKey,
+			usernames[peer.PublicKey])
+	}
+	if len(diff.missing) > 0 || len(diff.changed) > 0 {
+		wgPeers := append(append([]wgmanager.Peer{}, diff.missing...), diff.changed...)
+		if err := s.wgManager.AddPeers(wgPeers); err != nil {
+			return fmt.Errorf("error adding peers to WireGuard: %w", err)
+		}
+		s.countReconciledPeers("added", len(diff.missing))
+		s.countReconciledPeers("updated", len(diff.changed))
+	}
+
+	if len(diff.unexpected) == 0 {
+		return nil
+	}
+	if s.unexpectedPeerPolicy == ReportUnexpectedPeers {
+		for _, publicKey := range diff.unexpected {
+			log.Printf("Peer %s in WireGuard does not belong to an active config", publicKey)
+		}
+		s.countReconciledPeers("reported", len(diff.unexpected))
+		return nil
+	}
+	for _, publicKey := range diff.unexpected {
+		log.Printf("Removing peer %s from WireGuard which does not belong to an active config", publicKey)
+	}
+	if err := s.wgManager.RemovePeers(diff.unexpected); err != nil {
+		return fmt.Errorf("error removing peers from WireGuard: %w", err)
+	}
+	s.countReconciledPeers("removed", len(diff.unexpected))
+	return nil
+}
+
+func (s *Server) countReconciledPeers(action string, amount int) {
+	if s.metrics != nil && amount > 0 {
+		s.metrics.countReconciledPeers(action, amount)
+	}
+}
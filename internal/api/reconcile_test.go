@@ -0,0 +1,143 @@
+package api
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fantostisch/wireguard-daemon/wgmanager"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// recordingWGManager records the peers added to and removed from WireGuard.
+type recordingWGManager struct {
+	TestWGManager
+	added   *[]wgmanager.Peer
+	removed *[]PublicKey
+}
+
+func (wgm recordingWGManager) AddPeers(peers []wgmanager.Peer) error {
+	*wgm.added = append(*wgm.added, peers...)
+	return nil
+}
+
+func (wgm recordingWGManager) RemovePeers(publicKeys []PublicKey) error {
+	*wgm.removed = append(*wgm.removed, publicKeys...)
+	return nil
+}
+
+func TestReconcilePeers(t *testing.T) {
+	unexpectedKey, _ := wgtypes.GeneratePrivateKey()
+
+	var tests = []struct {
+		policy     UnexpectedPeerPolicy
+		expRemoved int
+		expMetrics []string
+	}{
+		{RemoveUnexpectedPeers, 1, []string{
+			`wireguard_daemon_reconciled_peers_total{action="added"} 1` + "\n",
+			`wireguard_daemon_reconciled_peers_total{action="updated"} 1` + "\n",
+			`wireguard_daemon_reconciled_peers_total{action="removed"} 1` + "\n",
+		}},
+		{ReportUnexpectedPeers, 0, []string{
+			`wireguard_daemon_reconciled_peers_total{action="reported"} 1` + "\n",
+		}},
+	}
+
+	for _, test := range tests {
+		setup()
+		server.metrics = newMetrics()
+		server.unexpectedPeerPolicy = test.policy
+		expected := server.expectedPeers(time.Now())
+		actual := wgPeers(expected)
+		actual[1].AllowedIPs = actual[1].AllowedIPs[:1]
+		actual = append(actual[:2], wgtypes.Peer{PublicKey: unexpectedKey})
+
+		var added []wgmanager.Peer
+		var removed []PublicKey
+		server.wgManager = recordingWGManager{
+			TestWGManager: TestWGManager{getPeersPeerList: actual},
+			added:         &added,
+			removed:       &removed,
+		}
+		if err := server.reconcilePeers(time.Now()); err != nil {
+			t.Fatalf("Error reconciling peers: %s", err)
+		}
+
+		// Missing peers are added before changed peers.
+		if len(added) != 2 || added[0].PublicKey != expected[2].PublicKey ||
+			added[1].PublicKey != expected[1].PublicKey {
+			t.Errorf("%s: unexpected added peers: %v", test.policy, added)
+		}
+		if len(removed) != test.expRemoved || (test.expRemoved == 1 && removed[0].Key != unexpectedKey) {
+			t.Errorf("%s: unexpected removed peers: %v", test.policy, removed)
+		}
+
+		var b strings.Builder
+		server.metrics.write(&b)
+		for _, exp := range test.expMetrics {
+			if !strings.Contains(b.String(), exp) {
+				t.Errorf("%s: metrics do not contain %q:\n%s", test.policy, exp, b.String())
+			}
+		}
+	}
+
+	// Nothing is changed when WireGuard matches storage.
+	setup()
+	var added []wgmanager.Peer
+	var removed []PublicKey
+	server.wgManager = recordingWGManager{
+		TestWGManager: TestWGManager{getPeersPeerList: wgPeers(server.expectedPeers(time.Now()))},
+		added:         &added,
+		removed:       &removed,
+	}
+	if err := server.reconcilePeers(time.Now()); err != nil {
+		t.Fatalf("Error reconciling peers: %s", err)
+	}
+	if len(added) != 0 || len(removed) != 0 {
+		t.Errorf("Peers changed while WireGuard matches storage, added: %v, removed: %v", added, removed)
+	}
+}
+
+// testLinkWatcher reports the interface was created a number of times and then fails.
+type testLinkWatcher struct {
+	creations *int
+}
+
+func (w testLinkWatcher) WaitCreated() error {
+	if *w.creations == 0 {
+		return errors.New("stopped watching")
+	}
+	*w.creations--
+	return nil
+}
+
+// configureRecordingWGManager records the peers WireGuard is configured with.
+type configureRecordingWGManager struct {
+	TestWGManager
+	configured *[][]wgmanager.Peer
+}
+
+func (wgm configureRecordingWGManager) ConfigureWG(peers []wgmanager.Peer) error {
+	*wgm.configured = append(*wgm.configured, peers)
+	return nil
+}
+
+func TestConfigureWGOnLinkCreation(t *testing.T) {
+	setup()
+	creations := 2
+	var configured [][]wgmanager.Peer
+	server.linkWatcher = testLinkWatcher{creations: &creations}
+	server.wgManager = configureRecordingWGManager{configured: &configured}
+
+	// Returns when the watcher fails.
+	server.configureWGOnLinkCreation()
+
+	if len(configured) != 2 {
+		t.Fatalf("WireGuard configured %d times, expected 2", len(configured))
+	}
+	if diff := diffPeers(server.expectedPeers(time.Now()), wgPeers(configured[1])); !diff.empty() {
+		t.Errorf("WireGuard configured with other peers than in storage: %s", diff)
+	}
+}
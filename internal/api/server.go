@@ -1,26 +1,166 @@
 package api
 
 import (
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"log"
 	"net"
 	"net/http"
+	"sync"
+	"time"
 
 	"github.com/fantostisch/wireguard-daemon/wgmanager"
 )
 
 type Server struct {
-	wgInterface   string
-	Storage       *FileStorage
-	IPAddr        net.IP
-	clientIPRange *net.IPNet
-	wgManager     wgmanager.IWGManager
-	wgPublicKey   PublicKey
+	wgInterface          string
+	Storage              Storage
+	addressPools         map[string]AddressPool
+	allocators           map[string]poolAllocator
+	disabledUserIPPolicy DisabledUserIPPolicy
+	maxConfigsPerUser    int
+	monthlyQuota         int64
+	expiredConfigPolicy  ExpiredConfigPolicy
+	authenticator        *Authenticator
+	clientConfigTemplate ClientConfigTemplate
+	usage                *UsageStorage
+	usageSampleInterval  time.Duration
+	sessions             *SessionLog
+	reconcileInterval    time.Duration
+	unexpectedPeerPolicy UnexpectedPeerPolicy
+	linkWatcher          LinkWatcher
+	metrics              *Metrics
+	wgManager            wgmanager.IWGManager
+	wgPublicKey          PublicKey
+	// Closed by Stop to stop the periodic tasks.
+	stop     chan struct{}
+	stopOnce sync.Once
+	// Periodic tasks which are running.
+	tasks      sync.WaitGroup
+	httpMutex  sync.Mutex
+	httpServer *http.Server
 }
 
-func NewServer(storage *FileStorage, wgManager wgmanager.IWGManager, wgInterface string) (*Server, error) {
-	IPAddr, ipNet, err := net.ParseCIDR("10.0.0.1/8") // todo: ip range should be configurable
+// Config contains the settings of the server.
+type Config struct {
+	WGInterface string
+	// Pools clients get their addresses from, must contain DefaultPool. The addresses of the server in the pools must
+	// be set on the WireGuard interface.
+	AddressPools         map[string]AddressPool
+	DisabledUserIPPolicy DisabledUserIPPolicy
+	// Maximum amount of configs of a user if no limit is set for the user. 0 means unlimited.
+	MaxConfigsPerUser   int
+	ExpiredConfigPolicy ExpiredConfigPolicy
+	// Authenticator for API requests, nil disables authentication.
+	Authenticator *Authenticator
+	// Settings used to create configuration files for clients. If no endpoint is set, configuration files are not
+	// available.
+	ClientConfigTemplate ClientConfigTemplate
+	// Storage for the traffic of configs, nil disables traffic accounting.
+	Usage *UsageStorage
+	// How often the traffic counters of WireGuard are read for traffic accounting.
+	UsageSampleInterval time.Duration
+	// Maximum amount of bytes a user can receive and transmit per month if no quota is set for the user. 0 means
+	// unlimited. Requires traffic accounting.
+	MonthlyQuota int64
+	// Log of sessions of clients, nil disables recording sessions.
+	SessionLog *SessionLog
+	// How often the peers in WireGuard are compared with storage and corrected, 0 disables reconciliation.
+	ReconcileInterval time.Duration
+	// What happens with peers in WireGuard which do not belong to an active config during reconciliation.
+	UnexpectedPeerPolicy UnexpectedPeerPolicy
+	// Reports when the WireGuard interface is created, nil disables configuring WireGuard when the interface is
+	// recreated.
+	LinkWatcher LinkWatcher
+}
+
+// LinkWatcher reports when the WireGuard interface is created.
+type LinkWatcher interface {
+	// WaitCreated blocks until the interface is created.
+	WaitCreated() error
+}
+
+// DisabledUserIPPolicy determines what happens with the addresses of a user when the user is disabled.
+type DisabledUserIPPolicy string
+
+const (
+	// KeepIPs keeps the addresses of disabled users, they get the same addresses when they are enabled again.
+	KeepIPs DisabledUserIPPolicy = "keep"
+	// ReleaseIPs releases the addresses of disabled users, they get new addresses when they are enabled again.
+	ReleaseIPs DisabledUserIPPolicy = "release"
+)
+
+// ExpiredConfigPolicy determines what happens with configs of which the expiry time has passed.
+type ExpiredConfigPolicy string
+
+const (
+	// DeleteExpiredConfigs deletes expired configs and releases their addresses.
+	DeleteExpiredConfigs ExpiredConfigPolicy = "delete"
+	// MarkExpiredConfigs keeps expired configs, they are marked as expired and can only be deleted.
+	MarkExpiredConfigs ExpiredConfigPolicy = "mark"
+)
+
+// How often is checked for expired configs.
+const expiryCheckInterval = time.Minute
+
+type poolAllocator struct {
+	ipv4 *ipAllocator
+	ipv6 *ipAllocator
+}
+
+func NewServer(storage Storage, wgManager wgmanager.IWGManager, config Config) (*Server, error) {
+	metrics := newMetrics()
+	wgManager = metricsWGManager{IWGManager: wgManager, metrics: metrics}
+	if writeObserver, ok := storage.(WriteObserver); ok {
+		writeObserver.SetWriteObserver(metrics.observeStorageWrite)
+	}
+
+	if _, exists := config.AddressPools[DefaultPool]; !exists {
+		return nil, fmt.Errorf("no address pool named '%s'", DefaultPool)
+	}
+	switch config.DisabledUserIPPolicy {
+	case KeepIPs, ReleaseIPs:
+	default:
+		return nil, fmt.Errorf("invalid policy for addresses of disabled users: '%s'", config.DisabledUserIPPolicy)
+	}
+	switch config.ExpiredConfigPolicy {
+	case DeleteExpiredConfigs, MarkExpiredConfigs:
+	default:
+		return nil, fmt.Errorf("invalid policy for expired configs: '%s'", config.ExpiredConfigPolicy)
+	}
+	if config.ReconcileInterval < 0 {
+		return nil, errors.New("reconcile interval can not be negative")
+	}
+	switch config.UnexpectedPeerPolicy {
+	case RemoveUnexpectedPeers, ReportUnexpectedPeers:
+	default:
+		return nil, fmt.Errorf("invalid policy for unexpected peers: '%s'", config.UnexpectedPeerPolicy)
+	}
+	if config.Usage != nil && config.UsageSampleInterval <= 0 {
+		return nil, errors.New("usage sample interval must be positive")
+	}
+	if config.MonthlyQuota < 0 {
+		return nil, errors.New("monthly quota can not be negative")
+	}
+	if config.MonthlyQuota > 0 && config.Usage == nil {
+		return nil, errors.New("a monthly quota requires traffic accounting")
+	}
+
+	interfaceAddresses, err := wgManager.GetInterfaceAddresses()
 	if err != nil {
-		return nil, fmt.Errorf("error parsing CIDR notation: %w", err)
+		return nil, fmt.Errorf("error getting addresses of WireGuard interface: %w", err)
+	}
+	for name, addressPool := range config.AddressPools {
+		if err := addressPool.checkInterfaceAddresses(interfaceAddresses); err != nil {
+			return nil, fmt.Errorf("address pool '%s' does not match WireGuard interface %s: %w",
+				name, config.WGInterface, err)
+		}
+		for otherName, otherAddressPool := range config.AddressPools {
+			if name != otherName && addressPool.overlaps(otherAddressPool) {
+				return nil, fmt.Errorf("address pools '%s' and '%s' overlap", name, otherName)
+			}
+		}
 	}
 
 	wgPublicKey, err := wgManager.GetPublicKey()
@@ -29,67 +169,408 @@ func NewServer(storage *FileStorage, wgManager wgmanager.IWGManager, wgInterface
 	}
 
 	surf := Server{
-		wgInterface:   wgInterface,
-		Storage:       storage,
-		IPAddr:        IPAddr,
-		clientIPRange: ipNet,
-		wgManager:     wgManager,
-		wgPublicKey:   wgPublicKey,
+		wgInterface:          config.WGInterface,
+		Storage:              storage,
+		disabledUserIPPolicy: config.DisabledUserIPPolicy,
+		maxConfigsPerUser:    config.MaxConfigsPerUser,
+		monthlyQuota:         config.MonthlyQuota,
+		expiredConfigPolicy:  config.ExpiredConfigPolicy,
+		authenticator:        config.Authenticator,
+		clientConfigTemplate: config.ClientConfigTemplate,
+		usage:                config.Usage,
+		usageSampleInterval:  config.UsageSampleInterval,
+		sessions:             config.SessionLog,
+		reconcileInterval:    config.ReconcileInterval,
+		unexpectedPeerPolicy: config.UnexpectedPeerPolicy,
+		linkWatcher:          config.LinkWatcher,
+		metrics:              metrics,
+		wgManager:            wgManager,
+		wgPublicKey:          wgPublicKey,
+		stop:                 make(chan struct{}),
 	}
+	surf.setAddressPools(config.AddressPools)
 	return &surf, nil
 }
 
-func (s *Server) Start(listenAddress string) error {
+// Start configures WireGuard and serves the API. If tlsConfig is not nil, the API is served using TLS. Returns nil
+// after Stop is called.
+func (s *Server) Start(listenAddress string, tlsConfig *tls.Config) error {
 	err := s.configureWG()
 	if err != nil {
 		return err
 	}
+	s.startTask(s.removeExpiredConfigsPeriodically)
+	if s.usage != nil {
+		s.startTask(s.sampleUsagePeriodically)
+	}
+	if s.sessions != nil {
+		s.startTask(s.watchSessionsPeriodically)
+	}
+	if s.reconcileInterval > 0 {
+		s.startTask(s.reconcilePeersPeriodically)
+	}
+	if s.linkWatcher != nil {
+		// Waiting for the interface can not be interrupted, so this is not stopped by Stop.
+		go s.configureWGOnLinkCreation()
+	}
 
 	var router http.Handler = API{
 		UserHandler:       UserHandler{Server: s},
 		ConnectionHandler: ConnectionHandler{wgManager: s.wgManager, storage: s.Storage},
+		Authenticator:     s.authenticator,
+		Metrics:           s.metrics,
+	}
+	httpServer := &http.Server{
+		Addr:      listenAddress,
+		Handler:   router,
+		TLSConfig: tlsConfig,
 	}
-	return http.ListenAndServe(listenAddress, router)
+	s.httpMutex.Lock()
+	select {
+	case <-s.stop:
+		s.httpMutex.Unlock()
+		return nil
+	default:
+		s.httpServer = httpServer
+	}
+	s.httpMutex.Unlock()
+
+	if tlsConfig == nil {
+		err = httpServer.ListenAndServe()
+	} else {
+		err = httpServer.ListenAndServeTLS("", "")
+	}
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// startTask runs task in a goroutine, Stop waits until it returns.
+func (s *Server) startTask(task func()) {
+	s.tasks.Add(1)
+	go func() {
+		defer s.tasks.Done()
+		task()
+	}()
+}
+
+// Stop stops the periodic tasks and the API server and waits until the periodic tasks have returned.
+func (s *Server) Stop() error {
+	s.httpMutex.Lock()
+	s.stopOnce.Do(func() { close(s.stop) })
+	httpServer := s.httpServer
+	s.httpMutex.Unlock()
+
+	var err error
+	if httpServer != nil {
+		err = httpServer.Close()
+	}
+	s.tasks.Wait()
+	return err
 }
 
 func (s *Server) GetPublicKey() PublicKey {
 	return s.wgPublicKey
 }
 
-func (s *Server) allocateIP() (net.IP, *Error) {
+// getMaxConfigs returns the maximum amount of configs of a user, 0 means unlimited.
+func (s *Server) getMaxConfigs(username UserID) int {
+	if maxConfigs := s.Storage.GetMaxConfigs(username); maxConfigs != nil {
+		return *maxConfigs
+	}
+	return s.maxConfigsPerUser
+}
+
+// setAddressPools sets the pools addresses are allocated from and marks the addresses of the server and all
+// addresses in storage as used.
+func (s *Server) setAddressPools(addressPools map[string]AddressPool) {
 	allocatedIPs := s.Storage.GetAllocatedIPs()
-	allocatedIPs = append(allocatedIPs, s.IPAddr)
 
-	for ip := s.IPAddr.Mask(s.clientIPRange.Mask); s.clientIPRange.Contains(ip); {
-		for i := len(ip) - 1; i >= 0; i-- {
-			ip[i]++
-			if ip[i] > 0 {
-				break
+	s.addressPools = addressPools
+	s.allocators = map[string]poolAllocator{}
+	for name, pool := range addressPools {
+		allocator := poolAllocator{
+			ipv4: newIPAllocator(pool.IPv4Range),
+			ipv6: newIPAllocator(pool.IPv6Range),
+		}
+		allocator.ipv4.markUsed(pool.IPv4Addr)
+		allocator.ipv6.markUsed(pool.IPv6Addr)
+		for _, ip := range allocatedIPs {
+			allocator.ipv4.markUsed(ip)
+			allocator.ipv6.markUsed(ip)
+		}
+		s.allocators[name] = allocator
+	}
+}
+
+// allocateIPs returns a free IPv4 and a free IPv6 address from the pool with name poolName. The addresses are marked
+// as used until they are released using releaseIPs.
+func (s *Server) allocateIPs(poolName string) (net.IP, net.IP, *Error) {
+	allocator, exists := s.allocators[poolName]
+	if !exists {
+		return nil, nil, &UnknownPool
+	}
+
+	ip, available := allocator.ipv4.allocate()
+	if !available {
+		return nil, nil, &NoIPAvailable
+	}
+	ipv6, available := allocator.ipv6.allocate()
+	if !available {
+		allocator.ipv4.release(ip)
+		return nil, nil, &NoIPAvailable
+	}
+	return ip, ipv6, nil
+}
+
+// releaseIPs makes the addresses of config available for new configs.
+func (s *Server) releaseIPs(config ClientConfig) {
+	for name, allocator := range s.allocators {
+		pool := s.addressPools[name]
+		for _, ip := range config.IPs() {
+			if ip.Equal(pool.IPv4Addr) || ip.Equal(pool.IPv6Addr) {
+				continue
 			}
+			allocator.ipv4.release(ip)
+			allocator.ipv6.release(ip)
+		}
+	}
+}
+
+// releaseUserIPs releases the addresses of all configs of a user and removes the addresses from the configs.
+func (s *Server) releaseUserIPs(username UserID) error {
+	return s.Storage.UpdateConfigs(username, func(publicKey PublicKey, config *ClientConfig) {
+		s.releaseIPs(*config)
+		config.IP = nil
+		config.IPv6 = nil
+	})
+}
+
+// assignUserIPs gives configs of a user without addresses new addresses from the pool of the config. If not enough
+// addresses are available no configs are changed.
+func (s *Server) assignUserIPs(username UserID) error {
+	allocated := map[PublicKey]ClientConfig{}
+	for publicKey, config := range s.Storage.GetUserClients(username) {
+		if config.IP != nil {
+			continue
+		}
+		pool := config.Pool
+		if pool == "" {
+			pool = DefaultPool
 		}
-		allocated := false
-		for _, allocatedIP := range allocatedIPs {
-			if allocatedIP.Equal(ip) {
-				allocated = true
-				break
+		ip, ipv6, err := s.allocateIPs(pool)
+		if err != nil {
+			for _, allocatedConfig := range allocated {
+				s.releaseIPs(allocatedConfig)
 			}
+			return err
 		}
-		if !allocated {
-			return ip, nil
+		allocated[publicKey] = ClientConfig{IP: ip, IPv6: ipv6}
+	}
+	if len(allocated) == 0 {
+		return nil
+	}
+
+	return s.Storage.UpdateConfigs(username, func(publicKey PublicKey, config *ClientConfig) {
+		if allocatedConfig, exists := allocated[publicKey]; exists {
+			config.IP = allocatedConfig.IP
+			config.IPv6 = allocatedConfig.IPv6
 		}
+	})
+}
+
+// disableUser disables a user for reason and removes the configs of the user from WireGuard. Returns false if the user
+// was already disabled for the same reason. If the user was already disabled for another reason, only the reason is
+// changed.
+func (s *Server) disableUser(username UserID, reason DisabledReason) (bool, error) {
+	previous, err := s.Storage.SetDisabled(username, reason)
+	if err != nil {
+		return false, err
+	}
+	if previous == reason {
+		return false, nil
 	}
-	return nil, &NoIPAvailable
+	if previous != NotDisabled {
+		return true, nil
+	}
+	return true, s.removeUserPeers(username)
 }
 
-func (s *Server) configureWG() error {
-	enabledUsers := s.Storage.GetEnabledUsers()
+func (s *Server) removeUserPeers(username UserID) error {
+	var publicKeys []PublicKey
+	for publicKey := range s.Storage.GetUserClients(username) {
+		publicKeys = append(publicKeys, publicKey)
+	}
+	if err := s.wgManager.RemovePeers(publicKeys); err != nil {
+		return fmt.Errorf("error reconfiguring WireGuard: %w", err)
+	}
 
+	if s.disabledUserIPPolicy == ReleaseIPs {
+		if err := s.releaseUserIPs(username); err != nil {
+			return fmt.Errorf("error releasing addresses: %w", err)
+		}
+	}
+	return nil
+}
+
+// enableUser enables a user and adds the configs of the user to WireGuard. Returns false if the user was already
+// enabled. If the addresses of the user were released and not enough addresses are available, the user stays disabled
+// and NoIPAvailable is returned, UnknownPool if the pool of a config does not exist anymore.
+func (s *Server) enableUser(username UserID) (bool, error) {
+	previous, err := s.Storage.SetDisabled(username, NotDisabled)
+	if err != nil {
+		return false, err
+	}
+	if previous == NotDisabled {
+		return false, nil
+	}
+	if err := s.assignUserIPs(username); err != nil {
+		if err.Error() == NoIPAvailable.Error() || err.Error() == UnknownPool.Error() {
+			if _, err := s.Storage.SetDisabled(username, previous); err != nil {
+				return false, fmt.Errorf("error disabling user: %w", err)
+			}
+			return false, err
+		}
+		return true, fmt.Errorf("error assigning addresses: %w", err)
+	}
+	return true, s.addUserPeers(username)
+}
+
+// addUserPeers adds the configs of a user to WireGuard.
+func (s *Server) addUserPeers(username UserID) error {
+
+	now := time.Now()
 	var wgPeers []wgmanager.Peer
-	for _, user := range enabledUsers {
-		for publicKey, config := range user.Clients {
+	for publicKey, config := range s.Storage.GetUserClients(username) {
+		if !config.isExpired(now) {
 			wgPeers = append(wgPeers, ClientToWGPeer(publicKey, config))
 		}
 	}
+	if err := s.wgManager.AddPeers(wgPeers); err != nil {
+		return fmt.Errorf("error reconfiguring WireGuard: %w", err)
+	}
+	return nil
+}
 
-	return s.wgManager.ConfigureWG(wgPeers)
+// checkAllowedIPs checks that the extra networks routed to the config with publicKey do not overlap with each other,
+// the address pools or the networks routed to other configs.
+func (s *Server) checkAllowedIPs(publicKey PublicKey, allowedIPs []Subnet) error {
+	if len(allowedIPs) == 0 {
+		return nil
+	}
+	clients := s.Storage.GetAllClients()
+	for i := range allowedIPs {
+		subnet := &allowedIPs[i].IPNet
+		for j := range allowedIPs[:i] {
+			if ipNetsOverlap(subnet, &allowedIPs[j].IPNet) {
+				return fmt.Errorf("%s overlaps with %s", subnet, &allowedIPs[j].IPNet)
+			}
+		}
+		for name, pool := range s.addressPools {
+			if ipNetsOverlap(subnet, pool.IPv4Range) || ipNetsOverlap(subnet, pool.IPv6Range) {
+				return fmt.Errorf("%s overlaps with address pool '%s'", subnet, name)
+			}
+		}
+		for otherPublicKey, config := range clients {
+			if otherPublicKey == publicKey {
+				continue
+			}
+			for _, ipNet := range ClientToWGPeer(otherPublicKey, config).AllowedIPs {
+				ipNet := ipNet
+				if ipNetsOverlap(subnet, &ipNet) {
+					return fmt.Errorf("%s overlaps with %s of config %s", subnet, &ipNet, otherPublicKey)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// isPeerActive returns if a config of a user should be added to WireGuard.
+func (s *Server) isPeerActive(username UserID, config ClientConfig) bool {
+	return !s.Storage.IsDisabled(username) && !config.isExpired(time.Now())
+}
+
+func (s *Server) removeExpiredConfigsPeriodically() {
+	ticker := time.NewTicker(expiryCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case now := <-ticker.C:
+			if err := s.removeExpiredConfigs(now); err != nil {
+				log.Print("Error removing expired configs: ", err)
+			}
+		}
+	}
+}
+
+// removeExpiredConfigs removes configs of which the expiry time has passed from WireGuard and deletes them or marks
+// them as expired depending on the policy.
+func (s *Server) removeExpiredConfigs(now time.Time) error {
+	type expiredConfig struct {
+		username  UserID
+		publicKey PublicKey
+		config    ClientConfig
+	}
+	var expiredConfigs []expiredConfig
+	var publicKeys []PublicKey
+	for username, user := range s.Storage.GetAllUsers() {
+		for publicKey, config := range user.Clients {
+			if !config.Expired && config.isExpired(now) {
+				expiredConfigs = append(expiredConfigs, expiredConfig{username, publicKey, config})
+				publicKeys = append(publicKeys, publicKey)
+			}
+		}
+	}
+	if len(expiredConfigs) == 0 {
+		return nil
+	}
+
+	if err := s.wgManager.RemovePeers(publicKeys); err != nil {
+		return fmt.Errorf("error removing peers from WireGuard: %w", err)
+	}
+
+	for _, expired := range expiredConfigs {
+		switch s.expiredConfigPolicy {
+		case MarkExpiredConfigs:
+			_, _, err := s.Storage.UpdateConfig(expired.username, expired.publicKey, func(config *ClientConfig) {
+				config.Expired = true
+			})
+			if err != nil {
+				return fmt.Errorf("error marking config as expired: %w", err)
+			}
+		default:
+			deleted, err := s.Storage.DeleteConfig(expired.username, expired.publicKey)
+			if err != nil {
+				return fmt.Errorf("error deleting expired config: %w", err)
+			}
+			if deleted {
+				s.releaseIPs(expired.config)
+			}
+		}
+		log.Printf("Config %s of user %s expired", expired.publicKey, expired.username)
+	}
+	return nil
+}
+
+// configureWGOnLinkCreation configures WireGuard every time the interface is created, for example when it is recreated
+// without peers by systemd-networkd.
+func (s *Server) configureWGOnLinkCreation() {
+	for {
+		if err := s.linkWatcher.WaitCreated(); err != nil {
+			log.Print("Error watching WireGuard interface, it is no longer configured when it is recreated: ", err)
+			return
+		}
+		log.Printf("WireGuard interface %s was created, configuring peers", s.wgInterface)
+		if err := s.configureWG(); err != nil {
+			log.Print("Error configuring WireGuard: ", err)
+		}
+	}
+}
+
+func (s *Server) configureWG() error {
+	return s.wgManager.ConfigureWG(s.expectedPeers(time.Now()))
 }
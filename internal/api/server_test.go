@@ -0,0 +1,35 @@
+package api
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStop(t *testing.T) {
+	setup()
+	server.stop = make(chan struct{})
+	server.reconcileInterval = time.Millisecond
+	server.wgManager = TestWGManager{getPeersPeerList: wgPeers(server.expectedPeers(time.Now()))}
+
+	started := make(chan error)
+	go func() { started <- server.Start("127.0.0.1:0", nil) }()
+	server.startTask(server.reconcilePeersPeriodically)
+	time.Sleep(10 * time.Millisecond)
+
+	stopped := make(chan error)
+	go func() { stopped <- server.Stop() }()
+	for _, result := range []chan error{stopped, started} {
+		select {
+		case err := <-result:
+			if err != nil {
+				t.Errorf("Unexpected error: %s", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Server did not stop")
+		}
+	}
+	// Stopping again does nothing.
+	if err := server.Stop(); err != nil {
+		t.Errorf("Error stopping server again: %s", err)
+	}
+}
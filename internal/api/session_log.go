@@ -0,0 +1,306 @@
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fantostisch/wireguard-daemon/wgmanager"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Session is a period in which a client was connected from one endpoint.
+type Session struct {
+	Username  UserID    `json:"username"`
+	PublicKey PublicKey `json:"publicKey"`
+	Start     TimeJ     `json:"start"`
+	// Nil if the session has not ended.
+	End *TimeJ `json:"end"`
+	// IP address the client connected from.
+	Endpoint      string `json:"endpoint"`
+	ReceiveBytes  int64  `json:"receiveBytes"`
+	TransmitBytes int64  `json:"transmitBytes"`
+}
+
+type activeSession struct {
+	Session
+	lastHandshake time.Time
+	// Counters of WireGuard at the previous check.
+	lastCounters Usage
+}
+
+// SessionLog records sessions of clients. Sessions are appended to a file with one JSON object per line when they end.
+// Sessions which have not ended are only kept in memory, so sessions which are active when the daemon stops are not
+// recorded.
+type SessionLog struct {
+	filePath string
+	// Sessions which ended longer ago are removed when compacting, 0 keeps sessions forever.
+	retention time.Duration
+	mutex     sync.Mutex
+	active    map[PublicKey]*activeSession
+}
+
+// How often is checked for sessions which started or ended.
+const sessionCheckInterval = time.Minute
+
+// How often sessions older than the retention period are removed.
+const sessionCompactionInterval = 24 * time.Hour
+
+// OpenSessionLog opens the session log in filePath, the file is created if it does not exist.
+func OpenSessionLog(filePath string, retention time.Duration) (*SessionLog, error) {
+	if retention < 0 {
+		return nil, fmt.Errorf("session retention can not be negative")
+	}
+	file, err := os.OpenFile(filepath.Clean(filePath), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("could not open session log: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return nil, err
+	}
+	return &SessionLog{
+		filePath:  filePath,
+		retention: retention,
+		active:    map[PublicKey]*activeSession{},
+	}, nil
+}
+
+// Mutex should already be locked.
+func (l *SessionLog) append(sessions []Session) error {
+	if len(sessions) == 0 {
+		return nil
+	}
+	file, err := os.OpenFile(filepath.Clean(l.filePath), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(file)
+	for _, session := range sessions {
+		if err := encoder.Encode(session); err != nil {
+			_ = file.Close()
+			return err
+		}
+	}
+	return file.Close()
+}
+
+// Mutex should already be locked.
+func (l *SessionLog) read(include func(session Session) bool) ([]Session, error) {
+	file, err := os.Open(filepath.Clean(l.filePath))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var sessions []Session
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		var session Session
+		// A line can be incomplete if the daemon stopped while appending to the log, other sessions are still read.
+		if err := json.Unmarshal(scanner.Bytes(), &session); err != nil {
+			log.Printf("WARNING: skipping line %d of session log %s: %s", line, l.filePath, err)
+			continue
+		}
+		if include(session) {
+			sessions = append(sessions, session)
+		}
+	}
+	return sessions, scanner.Err()
+}
+
+// update starts sessions of peers which performed a handshake and ends sessions of peers which did not perform a
+// handshake for 3 minutes or were removed from WireGuard. When the endpoint of a client changes a new session is
+// started. usernames contains the user of every config, peers without config are ignored.
+func (l *SessionLog) update(peers []wgtypes.Peer, usernames map[PublicKey]UserID, now time.Time) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	var ended []Session
+	endSession := func(publicKey PublicKey, session *activeSession, end time.Time) {
+		session.End = &TimeJ{end.UTC()}
+		ended = append(ended, session.Session)
+		delete(l.active, publicKey)
+	}
+
+	seen := map[PublicKey]bool{}
+	for _, peer := range peers {
+		publicKey := PublicKey{peer.PublicKey}
+		username, exists := usernames[publicKey]
+		if !exists {
+			continue
+		}
+		seen[publicKey] = true
+		counters := Usage{ReceiveBytes: peer.ReceiveBytes, TransmitBytes: peer.TransmitBytes}
+		endpoint := ""
+		if peer.Endpoint != nil {
+			endpoint = peer.Endpoint.IP.String()
+		}
+
+		session := l.active[publicKey]
+		if session != nil {
+			session.ReceiveBytes += counterDelta(session.lastCounters.ReceiveBytes, counters.ReceiveBytes)
+			session.TransmitBytes += counterDelta(session.lastCounters.TransmitBytes, counters.TransmitBytes)
+			session.lastCounters = counters
+			if !wgmanager.IsConnected(peer, now) {
+				endSession(publicKey, session, sessionEnd(peer.LastHandshakeTime, now))
+				continue
+			}
+			session.lastHandshake = peer.LastHandshakeTime
+			if session.Endpoint == endpoint {
+				continue
+			}
+			endSession(publicKey, session, now)
+		}
+
+		if !wgmanager.IsConnected(peer, now) {
+			continue
+		}
+		start := peer.LastHandshakeTime
+		if session != nil {
+			start = now
+		}
+		l.active[publicKey] = &activeSession{
+			Session: Session{
+				Username:  username,
+				PublicKey: publicKey,
+				Start:     TimeJ{start.UTC()},
+				Endpoint:  endpoint,
+			},
+			lastHandshake: peer.LastHandshakeTime,
+			lastCounters:  counters,
+		}
+	}
+
+	for publicKey, session := range l.active {
+		if !seen[publicKey] {
+			endSession(publicKey, session, sessionEnd(session.lastHandshake, now))
+		}
+	}
+
+	return l.append(ended)
+}
+
+// sessionEnd returns when a session ended of which the last handshake was at lastHandshake. Without new handshake
+// WireGuard drops all packets after RejectAfterTime.
+func sessionEnd(lastHandshake time.Time, now time.Time) time.Time {
+	end := lastHandshake.Add(wgmanager.RejectAfterTime)
+	if end.After(now) {
+		return now
+	}
+	return end
+}
+
+// compact removes sessions which ended before the retention period.
+func (l *SessionLog) compact(now time.Time) error {
+	if l.retention == 0 {
+		return nil
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	oldest := now.Add(-l.retention)
+	sessions, err := l.read(func(session Session) bool {
+		return session.End == nil || !session.End.Before(oldest)
+	})
+	if err != nil {
+		return err
+	}
+
+	tempFile, err := ioutil.TempFile(filepath.Dir(l.filePath), filepath.Base(l.filePath)+".tmp")
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(tempFile)
+	for _, session := range sessions {
+		if err := encoder.Encode(session); err != nil {
+			_ = tempFile.Close()
+			_ = os.Remove(tempFile.Name())
+			return err
+		}
+	}
+	if err := tempFile.Sync(); err != nil {
+		_ = tempFile.Close()
+		_ = os.Remove(tempFile.Name())
+		return err
+	}
+	if err := tempFile.Close(); err != nil {
+		_ = os.Remove(tempFile.Name())
+		return err
+	}
+	return os.Rename(tempFile.Name(), l.filePath)
+}
+
+// GetSessions returns the sessions of a user which were active between from and to, including sessions which have not
+// ended, sorted by start time. A zero to means no upper bound. If publicKey is not nil only sessions of that config
+// are returned.
+func (l *SessionLog) GetSessions(username UserID, publicKey *PublicKey, from time.Time,
+	to time.Time) ([]Session, error) {
+
+	include := func(session Session) bool {
+		if session.Username != username || (publicKey != nil && session.PublicKey != *publicKey) {
+			return false
+		}
+		return (to.IsZero() || !session.Start.After(to)) && (session.End == nil || !session.End.Before(from))
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	sessions, err := l.read(include)
+	if err != nil {
+		return nil, err
+	}
+	for _, session := range l.active {
+		if include(session.Session) {
+			sessions = append(sessions, session.Session)
+		}
+	}
+	sort.SliceStable(sessions, func(i, j int) bool {
+		return sessions[i].Start.Before(sessions[j].Start.Time)
+	})
+	if sessions == nil {
+		sessions = []Session{}
+	}
+	return sessions, nil
+}
+
+func (s *Server) watchSessionsPeriodically() {
+	if err := s.sessions.compact(time.Now()); err != nil {
+		log.Print("Error compacting session log: ", err)
+	}
+	lastCompaction := time.Now()
+
+	ticker := time.NewTicker(sessionCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case now := <-ticker.C:
+			if err := s.updateSessions(now); err != nil {
+				log.Print("Error recording sessions: ", err)
+			}
+			if now.Sub(lastCompaction) >= sessionCompactionInterval {
+				if err := s.sessions.compact(now); err != nil {
+					log.Print("Error compacting session log: ", err)
+				}
+				lastCompaction = now
+			}
+		}
+	}
+}
+
+func (s *Server) updateSessions(now time.Time) error {
+	peers, err := s.wgManager.GetPeers()
+	if err != nil {
+		return fmt.Errorf("error getting WireGuard peers: %w", err)
+	}
+	return s.sessions.update(peers, s.Storage.GetUsernames(), now)
+}
@@ -0,0 +1,180 @@
+package api
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func newTestSessionLog(t *testing.T, retention time.Duration) (*SessionLog, func()) {
+	dir, err := ioutil.TempDir("", "sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessionLog, err := OpenSessionLog(filepath.Join(dir, "sessions.jsonl"), retention)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sessionLog, func() { os.RemoveAll(dir) }
+}
+
+func TestSessionLog(t *testing.T) {
+	sessionLog, cleanup := newTestSessionLog(t, 24*time.Hour)
+	defer cleanup()
+	petersPublicKey1, _ := wgtypes.ParseKey(petersPublicKey1String)
+	petersPublicKey2, _ := wgtypes.ParseKey(petersPublicKey2String)
+	publicKey1 := PublicKey{petersPublicKey1}
+	publicKey2 := PublicKey{petersPublicKey2}
+	usernames := map[PublicKey]UserID{publicKey1: peterUsername, publicKey2: peterUsername}
+	endpointA := &net.UDPAddr{IP: net.IPv4(3, 141, 59, 26), Port: 4000}
+	endpointB := &net.UDPAddr{IP: net.IPv4(2, 71, 82, 81), Port: 5000}
+
+	t0 := time.Date(2020, 10, 13, 17, 0, 0, 0, time.UTC)
+	handshake1 := t0.Add(-10 * time.Second)
+	handshake2 := t0.Add(90 * time.Second)
+	var checks = []struct {
+		now   time.Time
+		peers []wgtypes.Peer
+	}{
+		{t0, []wgtypes.Peer{
+			{PublicKey: petersPublicKey1, Endpoint: endpointA, LastHandshakeTime: handshake1, ReceiveBytes: 100,
+				TransmitBytes: 10},
+			{PublicKey: petersPublicKey2, Endpoint: endpointA, LastHandshakeTime: handshake1},
+			// Peers without config are ignored.
+			{PublicKey: wgtypes.Key{}, Endpoint: endpointA, LastHandshakeTime: handshake1},
+		}},
+		// Config 2 was removed from WireGuard.
+		{t0.Add(time.Minute), []wgtypes.Peer{
+			{PublicKey: petersPublicKey1, Endpoint: endpointA, LastHandshakeTime: handshake1, ReceiveBytes: 300,
+				TransmitBytes: 30},
+		}},
+		// The endpoint changed.
+		{t0.Add(2 * time.Minute), []wgtypes.Peer{
+			{PublicKey: petersPublicKey1, Endpoint: endpointB, LastHandshakeTime: handshake2, ReceiveBytes: 400,
+				TransmitBytes: 40},
+		}},
+		{t0.Add(10 * time.Minute), []wgtypes.Peer{
+			{PublicKey: petersPublicKey1, Endpoint: endpointB, LastHandshakeTime: handshake2, ReceiveBytes: 450,
+				TransmitBytes: 45},
+			{PublicKey: petersPublicKey2, Endpoint: endpointB, LastHandshakeTime: t0.Add(9 * time.Minute)},
+		}},
+	}
+	for _, check := range checks {
+		if err := sessionLog.update(check.peers, usernames, check.now); err != nil {
+			t.Fatalf("Error updating sessions: %s", err)
+		}
+	}
+
+	// Sessions with the same start are in the order in which they ended.
+	exp := []Session{
+		{peterUsername, publicKey2, TimeJ{handshake1}, &TimeJ{t0.Add(time.Minute)}, "3.141.59.26", 0, 0},
+		{peterUsername, publicKey1, TimeJ{handshake1}, &TimeJ{t0.Add(2 * time.Minute)}, "3.141.59.26", 300, 30},
+		{peterUsername, publicKey1, TimeJ{t0.Add(2 * time.Minute)}, &TimeJ{handshake2.Add(3 * time.Minute)},
+			"2.71.82.81", 50, 5},
+		{peterUsername, publicKey2, TimeJ{t0.Add(9 * time.Minute)}, nil, "2.71.82.81", 0, 0},
+	}
+	got, err := sessionLog.GetSessions(peterUsername, nil, time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatalf("Error getting sessions: %s", err)
+	}
+	if !cmp.Equal(got, exp) {
+		t.Error("Diff: ", cmp.Diff(exp, got))
+	}
+
+	got, _ = sessionLog.GetSessions(peterUsername, &publicKey1, t0.Add(3*time.Minute), t0.Add(4*time.Minute))
+	if !cmp.Equal(got, exp[2:3]) {
+		t.Error("Diff: ", cmp.Diff(exp[2:3], got))
+	}
+	got, _ = sessionLog.GetSessions("Nick", nil, time.Time{}, time.Time{})
+	if len(got) != 0 {
+		t.Errorf("Got sessions of other user: %v", got)
+	}
+
+	// Sessions which ended before the retention period are removed.
+	if err := sessionLog.compact(t0.Add(24*time.Hour + 3*time.Minute)); err != nil {
+		t.Fatalf("Error compacting sessions: %s", err)
+	}
+	got, _ = sessionLog.GetSessions(peterUsername, nil, time.Time{}, time.Time{})
+	if !cmp.Equal(got, exp[2:]) {
+		t.Error("Diff: ", cmp.Diff(exp[2:], got))
+	}
+}
+
+func TestGetSessions(t *testing.T) {
+	setup()
+	sessionLog, cleanup := newTestSessionLog(t, 0)
+	defer cleanup()
+
+	var tests = []struct {
+		parameters url.Values
+		apiError   *Error
+		exp        string
+	}{
+		{url.Values{"user_id": {peterUsername}}, nil, "[]"},
+		{url.Values{"user_id": {peterUsername}, "public_key": {petersPublicKey1String},
+			"from": {"2020-10-13T17:00:00Z"}, "to": {"2020-10-14T17:00:00Z"}}, nil, "[]"},
+		{url.Values{"user_id": {peterUsername}, "from": {"yesterday"}}, &InvalidTimeRange, ""},
+		{url.Values{"user_id": {peterUsername}, "from": {"2020-10-14T17:00:00Z"}, "to": {"2020-10-13T17:00:00Z"}},
+			&InvalidTimeRange, ""},
+		{url.Values{"user_id": {peterUsername}, "public_key": {"invalid"}}, &InvalidPublicKey, ""},
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, "/sessions?"+tests[0].parameters.Encode(), nil)
+	respRec := httptest.NewRecorder()
+	apiRouter.ServeHTTP(respRec, req)
+	testError(t, *respRec, &SessionsUnavailable)
+
+	server.sessions = sessionLog
+	for _, test := range tests {
+		req, _ := http.NewRequest(http.MethodGet, "/sessions?"+test.parameters.Encode(), nil)
+		respRec := httptest.NewRecorder()
+		apiRouter.ServeHTTP(respRec, req)
+
+		testError(t, *respRec, test.apiError)
+		if test.apiError == nil && respRec.Body.String() != test.exp+"\n" {
+			t.Errorf("Got: %s, Wanted: %s", respRec.Body.String(), test.exp)
+		}
+	}
+}
+
+func TestSessionLogWithIncompleteLine(t *testing.T) {
+	sessionLog, cleanup := newTestSessionLog(t, 24*time.Hour)
+	defer cleanup()
+	petersPublicKey1, _ := wgtypes.ParseKey(petersPublicKey1String)
+	t0 := time.Date(2020, 10, 13, 17, 0, 0, 0, time.UTC)
+	session := Session{peterUsername, PublicKey{petersPublicKey1}, TimeJ{t0}, &TimeJ{t0.Add(time.Minute)},
+		"3.141.59.26", 100, 10}
+	line, _ := json.Marshal(session)
+
+	// The daemon stopped while appending a session.
+	content := append(append(line, '\n'), line[:len(line)/2]...)
+	if err := ioutil.WriteFile(sessionLog.filePath, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	got, err := sessionLog.GetSessions(peterUsername, nil, time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatalf("Error getting sessions: %s", err)
+	}
+	if !cmp.Equal(got, []Session{session}) {
+		t.Error("Diff: ", cmp.Diff([]Session{session}, got))
+	}
+
+	// Compacting removes the incomplete line.
+	if err := sessionLog.compact(t0); err != nil {
+		t.Fatalf("Error compacting sessions: %s", err)
+	}
+	compacted, _ := ioutil.ReadFile(sessionLog.filePath)
+	if string(compacted) != string(line)+"\n" {
+		t.Errorf("Unexpected session log after compacting: %s", compacted)
+	}
+}
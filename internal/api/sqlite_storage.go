@@ -0,0 +1,586 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	// Registers the sqlite3 driver.
+	_ "github.com/mattn/go-sqlite3"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// SQLiteStorage stores users and configs in a SQLite database, so a change does not rewrite all data. Configs are
+// stored as JSON, their public key and addresses are also stored in indexed columns.
+type SQLiteStorage struct {
+	db *sql.DB
+	// Locked during every method, so changes based on data read from the database are not lost.
+	mutex sync.Mutex
+	// Called with the duration of every write transaction, may be nil.
+	observeWrite func(duration time.Duration)
+}
+
+const sqliteSchema = `
+CREATE TABLE users (
+	username TEXT PRIMARY KEY,
+	is_disabled INTEGER NOT NULL DEFAULT 0,
+	disabled_reason TEXT NOT NULL DEFAULT '',
+	pool TEXT NOT NULL DEFAULT '',
+	max_configs INTEGER,
+	monthly_quota INTEGER
+);
+CREATE TABLE configs (
+	username TEXT NOT NULL REFERENCES users(username),
+	public_key TEXT NOT NULL,
+	ip TEXT,
+	ipv6 TEXT,
+	config TEXT NOT NULL,
+	PRIMARY KEY (username, public_key)
+);
+CREATE INDEX configs_public_key ON configs(public_key);
+CREATE INDEX configs_ip ON configs(ip);
+CREATE INDEX configs_ipv6 ON configs(ipv6);
+`
+
+// NewSQLiteStorage creates a database with an empty storage.
+func NewSQLiteStorage(filePath string) error {
+	if _, err := os.Stat(filePath); err == nil {
+		return fmt.Errorf("file '%s' already exists", filePath)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	db, err := openSQLite(filePath, "rwc")
+	if err != nil {
+		return err
+	}
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		_ = db.Close()
+		return fmt.Errorf("error creating tables: %w", err)
+	}
+	return db.Close()
+}
+
+// OpenSQLiteStorage opens a database created using NewSQLiteStorage.
+func OpenSQLiteStorage(filePath string) (*SQLiteStorage, error) {
+	if _, err := os.Stat(filePath); err != nil {
+		return nil, fmt.Errorf("could not open storage database: %w", err)
+	}
+	db, err := openSQLite(filePath, "rw")
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("could not open storage database: %w", err)
+	}
+	return &SQLiteStorage{db: db}, nil
+}
+
+func openSQLite(filePath string, mode string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite3",
+		fmt.Sprintf("file:%s?mode=%s&_foreign_keys=on&_busy_timeout=5000", filepath.Clean(filePath), mode))
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows one writer at a time, using one connection prevents busy errors.
+	db.SetMaxOpenConns(1)
+	return db, nil
+}
+
+func (s *SQLiteStorage) Close() error {
+	return s.db.Close()
+}
+
+// CheckWritable returns an error if the database can not be written.
+func (s *SQLiteStorage) CheckWritable() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	// Deleting nothing still requires a write lock.
+	if _, err := tx.Exec("DELETE FROM users WHERE 0"); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Rollback()
+}
+
+func (s *SQLiteStorage) SetWriteObserver(observeWrite func(duration time.Duration)) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.observeWrite = observeWrite
+}
+
+// write runs change in a transaction. The mutex should already be locked.
+func (s *SQLiteStorage) write(change func(tx *sql.Tx) error) error {
+	start := time.Now()
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := change(tx); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	err = tx.Commit()
+	if s.observeWrite != nil {
+		s.observeWrite(time.Since(start))
+	}
+	return err
+}
+
+// logError logs errors of methods which can not return errors.
+func logError(err error) {
+	if err != nil {
+		log.Print("Error reading storage database: ", err)
+	}
+}
+
+func parsePublicKey(s string) (PublicKey, error) {
+	key, err := wgtypes.ParseKey(s)
+	return PublicKey{key}, err
+}
+
+// ipString returns the address as stored in the database, nil for no address.
+func ipString(ip net.IP) interface{} {
+	if ip == nil {
+		return nil
+	}
+	return ip.String()
+}
+
+type querier interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// queryConfigs calls handle for every config returned by query, which must select the username, public key and
+// config.
+func queryConfigs(q querier, handle func(username UserID, publicKey PublicKey, config ClientConfig), query string,
+	args ...interface{}) error {
+
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var username, publicKeyString, configJSON string
+		if err := rows.Scan(&username, &publicKeyString, &configJSON); err != nil {
+			return err
+		}
+		publicKey, err := parsePublicKey(publicKeyString)
+		if err != nil {
+			return fmt.Errorf("invalid public key '%s': %w", publicKeyString, err)
+		}
+		var config ClientConfig
+		if err := json.Unmarshal([]byte(configJSON), &config); err != nil {
+			return fmt.Errorf("invalid config %s: %w", publicKeyString, err)
+		}
+		handle(UserID(username), publicKey, config)
+	}
+	return rows.Err()
+}
+
+// queryUsers returns all users with their configs.
+func (s *SQLiteStorage) queryUsers() (map[UserID]*User, error) {
+	rows, err := s.db.Query(selectUsers)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	users := map[UserID]*User{}
+	for rows.Next() {
+		var username string
+		user, err := scanUser(rows, &username)
+		if err != nil {
+			return nil, err
+		}
+		users[UserID(username)] = &user
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	err = queryConfigs(s.db, func(username UserID, publicKey PublicKey, config ClientConfig) {
+		if user := users[username]; user != nil {
+			user.Clients[publicKey] = config
+		}
+	}, "SELECT username, public_key, config FROM configs")
+	return users, err
+}
+
+const selectUsers = "SELECT username, is_disabled, disabled_reason, pool, max_configs, monthly_quota FROM users"
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanUser(row scanner, username *string) (User, error) {
+	var disabledReason string
+	var maxConfigs, monthlyQuota sql.NullInt64
+	user := User{Clients: map[PublicKey]ClientConfig{}}
+	err := row.Scan(username, &user.IsDisabled, &disabledReason, &user.Pool, &maxConfigs, &monthlyQuota)
+	if err != nil {
+		return User{}, err
+	}
+	user.DisabledReason = DisabledReason(disabledReason)
+	if maxConfigs.Valid {
+		value := int(maxConfigs.Int64)
+		user.MaxConfigs = &value
+	}
+	if monthlyQuota.Valid {
+		value := monthlyQuota.Int64
+		user.MonthlyQuota = &value
+	}
+	return user, nil
+}
+
+// getUser returns the user without configs, an enabled user without settings if the user does not exist.
+func (s *SQLiteStorage) getUser(username UserID) User {
+	var name string
+	user, err := scanUser(s.db.QueryRow(selectUsers+" WHERE username = ?", string(username)), &name)
+	if err == sql.ErrNoRows {
+		return User{}
+	}
+	if err != nil {
+		logError(err)
+		return User{}
+	}
+	return user
+}
+
+func createUser(tx *sql.Tx, username UserID) error {
+	_, err := tx.Exec("INSERT OR IGNORE INTO users (username) VALUES (?)", string(username))
+	return err
+}
+
+func saveConfig(tx *sql.Tx, username UserID, publicKey PublicKey, config ClientConfig) error {
+	configJSON, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT OR REPLACE INTO configs (username, public_key, ip, ipv6, config) VALUES (?, ?, ?, ?, ?)",
+		string(username), publicKey.String(), ipString(config.IP), ipString(config.IPv6), string(configJSON))
+	return err
+}
+
+func (s *SQLiteStorage) GetUserClients(username UserID) map[PublicKey]ClientConfig {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	clients := map[PublicKey]ClientConfig{}
+	logError(queryConfigs(s.db, func(_ UserID, publicKey PublicKey, config ClientConfig) {
+		clients[publicKey] = config
+	}, "SELECT username, public_key, config FROM configs WHERE username = ?", string(username)))
+	return clients
+}
+
+// GetAllUsers returns a copy of all users.
+func (s *SQLiteStorage) GetAllUsers() map[UserID]User {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	users, err := s.queryUsers()
+	logError(err)
+	result := map[UserID]User{}
+	for username, user := range users {
+		result[username] = *user
+	}
+	return result
+}
+
+// GetAllClients returns the configs of all users.
+func (s *SQLiteStorage) GetAllClients() map[PublicKey]ClientConfig {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	clients := map[PublicKey]ClientConfig{}
+	logError(queryConfigs(s.db, func(_ UserID, publicKey PublicKey, config ClientConfig) {
+		clients[publicKey] = config
+	}, "SELECT username, public_key, config FROM configs"))
+	return clients
+}
+
+// GetUsernames returns the user of every config.
+func (s *SQLiteStorage) GetUsernames() map[PublicKey]UserID {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	usernames := map[PublicKey]UserID{}
+	logError(queryConfigs(s.db, func(username UserID, publicKey PublicKey, _ ClientConfig) {
+		usernames[publicKey] = username
+	}, "SELECT username, public_key, config FROM configs"))
+	return usernames
+}
+
+func (s *SQLiteStorage) GetUsernameAndConfig(publicKey PublicKey) (UserID, ClientConfig, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	found := false
+	var foundUsername UserID
+	var foundConfig ClientConfig
+	err := queryConfigs(s.db, func(username UserID, _ PublicKey, config ClientConfig) {
+		found = true
+		foundUsername = username
+		foundConfig = config
+	}, "SELECT username, public_key, config FROM configs WHERE public_key = ? LIMIT 1", publicKey.String())
+	if err != nil {
+		return "", ClientConfig{}, err
+	}
+	if !found {
+		return "", ClientConfig{}, errors.New("no user found for this public key")
+	}
+	return foundUsername, foundConfig, nil
+}
+
+func (s *SQLiteStorage) UpdateOrCreateConfig(username UserID, publicKey PublicKey, config ClientConfig,
+	maxConfigs int) (bool, error) {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if maxConfigs > 0 {
+		var configs int
+		var exists bool
+		err := s.db.QueryRow("SELECT COUNT(*), COALESCE(SUM(public_key = ?), 0) > 0 FROM configs WHERE username = ?",
+			publicKey.String(), string(username)).Scan(&configs, &exists)
+		if err != nil {
+			return false, err
+		}
+		if !exists && configs >= maxConfigs {
+			return false, &ConfigLimitReached
+		}
+	}
+
+	for _, ip := range config.IPs() {
+		var used bool
+		err := s.db.QueryRow("SELECT EXISTS (SELECT 1 FROM configs WHERE ip = ?1 OR ipv6 = ?1)", ip.String()).
+			Scan(&used)
+		if err != nil {
+			return false, err
+		}
+		if used {
+			return false, nil
+		}
+	}
+
+	return true, s.write(func(tx *sql.Tx) error {
+		if err := createUser(tx, username); err != nil {
+			return err
+		}
+		return saveConfig(tx, username, publicKey, config)
+	})
+}
+
+// UpdateConfigs calls update for every config of the user and saves the changes.
+func (s *SQLiteStorage) UpdateConfigs(username UserID, update func(publicKey PublicKey, config *ClientConfig)) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.write(func(tx *sql.Tx) error {
+		clients := map[PublicKey]ClientConfig{}
+		err := queryConfigs(tx, func(_ UserID, publicKey PublicKey, config ClientConfig) {
+			clients[publicKey] = config
+		}, "SELECT username, public_key, config FROM configs WHERE username = ?", string(username))
+		if err != nil {
+			return err
+		}
+		for publicKey, config := range clients {
+			update(publicKey, &config)
+			if err := saveConfig(tx, username, publicKey, config); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// UpdateConfig calls update for a config and saves the changes. Returns the updated config and if the config exists.
+func (s *SQLiteStorage) UpdateConfig(username UserID, publicKey PublicKey,
+	update func(config *ClientConfig)) (ClientConfig, bool, error) {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	exists := false
+	var updated ClientConfig
+	err := s.write(func(tx *sql.Tx) error {
+		err := queryConfigs(tx, func(_ UserID, _ PublicKey, config ClientConfig) {
+			exists = true
+			updated = config
+		}, "SELECT username, public_key, config FROM configs WHERE username = ? AND public_key = ?",
+			string(username), publicKey.String())
+		if err != nil || !exists {
+			return err
+		}
+		update(&updated)
+		return saveConfig(tx, username, publicKey, updated)
+	})
+	if !exists {
+		return ClientConfig{}, false, err
+	}
+	return updated, true, err
+}
+
+// Return true if config was successfully deleted, false otherwise.
+func (s *SQLiteStorage) DeleteConfig(username UserID, publicKey PublicKey) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	deleted := false
+	err := s.write(func(tx *sql.Tx) error {
+		result, err := tx.Exec("DELETE FROM configs WHERE username = ? AND public_key = ?", string(username),
+			publicKey.String())
+		if err != nil {
+			return err
+		}
+		affected, err := result.RowsAffected()
+		deleted = affected > 0
+		return err
+	})
+	return deleted, err
+}
+
+func (s *SQLiteStorage) GetEnabledUsers() []User {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	users, err := s.queryUsers()
+	logError(err)
+	enabledUsers := make([]User, 0, len(users))
+	for _, user := range users {
+		if !user.IsDisabled {
+			enabledUsers = append(enabledUsers, *user)
+		}
+	}
+	return enabledUsers
+}
+
+func (s *SQLiteStorage) IsDisabled(username UserID) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	user := s.getUser(username)
+	return user.IsDisabled
+}
+
+// GetDisabledReason returns the reason a user is disabled, NotDisabled if the user is enabled.
+func (s *SQLiteStorage) GetDisabledReason(username UserID) DisabledReason {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	user := s.getUser(username)
+	return user.disabledReason()
+}
+
+// SetDisabled disables a user for reason, or enables the user if reason is NotDisabled, and returns the previous
+// reason.
+func (s *SQLiteStorage) SetDisabled(username UserID, reason DisabledReason) (DisabledReason, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	user := s.getUser(username)
+	previous := user.disabledReason()
+	if previous == reason {
+		return previous, nil
+	}
+	return previous, s.write(func(tx *sql.Tx) error {
+		if err := createUser(tx, username); err != nil {
+			return err
+		}
+		_, err := tx.Exec("UPDATE users SET is_disabled = ?, disabled_reason = ? WHERE username = ?",
+			reason != NotDisabled, string(reason), string(username))
+		return err
+	})
+}
+
+// GetUserPool returns the pool used for new configs of the user, an empty string if the user has no default pool.
+func (s *SQLiteStorage) GetUserPool(username UserID) string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	user := s.getUser(username)
+	return user.Pool
+}
+
+func (s *SQLiteStorage) SetUserPool(username UserID, pool string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.setUserColumn(username, "pool", pool)
+}
+
+// GetMaxConfigs returns the maximum amount of configs of the user, nil if the default of the server should be used.
+func (s *SQLiteStorage) GetMaxConfigs(username UserID) *int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	user := s.getUser(username)
+	return user.MaxConfigs
+}
+
+func (s *SQLiteStorage) SetMaxConfigs(username UserID, maxConfigs *int) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var value interface{}
+	if maxConfigs != nil {
+		value = *maxConfigs
+	}
+	return s.setUserColumn(username, "max_configs", value)
+}
+
+// GetMonthlyQuota returns the monthly traffic quota of the user in bytes, nil if the default of the server should be
+// used.
+func (s *SQLiteStorage) GetMonthlyQuota(username UserID) *int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	user := s.getUser(username)
+	return user.MonthlyQuota
+}
+
+func (s *SQLiteStorage) SetMonthlyQuota(username UserID, monthlyQuota *int64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var value interface{}
+	if monthlyQuota != nil {
+		value = *monthlyQuota
+	}
+	return s.setUserColumn(username, "monthly_quota", value)
+}
+
+// setUserColumn sets a column of the user, creating the user if it does not exist. column must be a constant.
+func (s *SQLiteStorage) setUserColumn(username UserID, column string, value interface{}) error {
+	return s.write(func(tx *sql.Tx) error {
+		if err := createUser(tx, username); err != nil {
+			return err
+		}
+		_, err := tx.Exec("UPDATE users SET "+column+" = ? WHERE username = ?", value, string(username))
+		return err
+	})
+}
+
+func (s *SQLiteStorage) GetAllocatedIPs() []net.IP {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	allocatedIPs := []net.IP{}
+	logError(queryConfigs(s.db, func(_ UserID, _ PublicKey, config ClientConfig) {
+		allocatedIPs = append(allocatedIPs, config.IPs()...)
+	}, "SELECT username, public_key, config FROM configs WHERE ip IS NOT NULL OR ipv6 IS NOT NULL"))
+	return allocatedIPs
+}
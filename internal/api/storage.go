@@ -0,0 +1,58 @@
+package api
+
+import (
+	"net"
+	"time"
+)
+
+// Storage stores users and their configs. Methods returning maps or users return copies, changing them does not
+// change the storage.
+type Storage interface {
+	GetUserClients(username UserID) map[PublicKey]ClientConfig
+	// GetAllUsers returns all users, including users without configs.
+	GetAllUsers() map[UserID]User
+	// GetAllClients returns the configs of all users.
+	GetAllClients() map[PublicKey]ClientConfig
+	// GetUsernames returns the user of every config.
+	GetUsernames() map[PublicKey]UserID
+	GetUsernameAndConfig(publicKey PublicKey) (UserID, ClientConfig, error)
+	// UpdateOrCreateConfig saves a config, creating the user if it does not exist. Returns false and does not save the
+	// config if one of its addresses is already used by a config. If maxConfigs is greater than 0 and the user already
+	// has maxConfigs configs, a new config is not saved and ConfigLimitReached is returned.
+	UpdateOrCreateConfig(username UserID, publicKey PublicKey, config ClientConfig, maxConfigs int) (bool, error)
+	// UpdateConfigs calls update for every config of the user and saves the changes.
+	UpdateConfigs(username UserID, update func(publicKey PublicKey, config *ClientConfig)) error
+	// UpdateConfig calls update for a config and saves the changes. Returns the updated config and if the config
+	// exists.
+	UpdateConfig(username UserID, publicKey PublicKey, update func(config *ClientConfig)) (ClientConfig, bool, error)
+	// DeleteConfig returns true if the config was deleted, false if it does not exist.
+	DeleteConfig(username UserID, publicKey PublicKey) (bool, error)
+	GetEnabledUsers() []User
+	IsDisabled(username UserID) bool
+	// GetDisabledReason returns the reason a user is disabled, NotDisabled if the user is enabled.
+	GetDisabledReason(username UserID) DisabledReason
+	// SetDisabled disables a user for reason, or enables the user if reason is NotDisabled, and returns the previous
+	// reason.
+	SetDisabled(username UserID, reason DisabledReason) (DisabledReason, error)
+	// GetUserPool returns the pool used for new configs of the user, an empty string if the user has no default pool.
+	GetUserPool(username UserID) string
+	SetUserPool(username UserID, pool string) error
+	// GetMaxConfigs returns the maximum amount of configs of the user, nil if the default of the server should be
+	// used.
+	GetMaxConfigs(username UserID) *int
+	SetMaxConfigs(username UserID, maxConfigs *int) error
+	// GetMonthlyQuota returns the monthly traffic quota of the user in bytes, nil if the default of the server should
+	// be used.
+	GetMonthlyQuota(username UserID) *int64
+	SetMonthlyQuota(username UserID, monthlyQuota *int64) error
+	// GetAllocatedIPs returns the addresses of all configs.
+	GetAllocatedIPs() []net.IP
+	// CheckWritable returns an error if changes can not be saved.
+	CheckWritable() error
+}
+
+// WriteObserver is optionally implemented by a Storage to report how long writes take, which is exposed as metric.
+type WriteObserver interface {
+	// SetWriteObserver sets a function which is called with the duration of every write.
+	SetWriteObserver(observeWrite func(duration time.Duration))
+}
@@ -0,0 +1,246 @@
+package api
+
+import (
+	"errors"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// storageBackends are the implementations of Storage the conformance tests run against.
+var storageBackends = []struct {
+	name   string
+	create func(filePath string) error
+	open   func(filePath string) (Storage, error)
+}{
+	{"file", NewFileStorage, func(filePath string) (Storage, error) { return ReadFile(filePath) }},
+	{"sqlite", NewSQLiteStorage, func(filePath string) (Storage, error) { return OpenSQLiteStorage(filePath) }},
+}
+
+func closeStorage(t *testing.T, storage Storage) {
+	if closer, ok := storage.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			t.Fatalf("Error closing storage: %s", err)
+		}
+	}
+}
+
+func TestStorageConformance(t *testing.T) {
+	for _, backend := range storageBackends {
+		backend := backend
+		t.Run(backend.name, func(t *testing.T) {
+			dir, cleanup := newTestStorageDir(t)
+			defer cleanup()
+			filePath := filepath.Join(dir, "storage")
+
+			if err := backend.create(filePath); err != nil {
+				t.Fatalf("Error creating storage: %s", err)
+			}
+			if err := backend.create(filePath); err == nil {
+				t.Error("Creating storage again did not fail")
+			}
+			storage, err := backend.open(filePath)
+			if err != nil {
+				t.Fatalf("Error opening storage: %s", err)
+			}
+			testStorage(t, storage)
+			exp := storage.GetAllUsers()
+			closeStorage(t, storage)
+
+			// All changes are saved.
+			storage, err = backend.open(filePath)
+			if err != nil {
+				t.Fatalf("Error opening storage again: %s", err)
+			}
+			defer closeStorage(t, storage)
+			if got := storage.GetAllUsers(); !cmp.Equal(got, exp) {
+				t.Error("Diff after opening storage again: ", cmp.Diff(exp, got))
+			}
+		})
+	}
+}
+
+func testStorage(t *testing.T, storage Storage) {
+	writes := 0
+	storage.(WriteObserver).SetWriteObserver(func(duration time.Duration) { writes++ })
+	if err := storage.CheckWritable(); err != nil {
+		t.Errorf("Storage is not writable: %s", err)
+	}
+
+	key1, _ := wgtypes.ParseKey(petersPublicKey1String)
+	key2, _ := wgtypes.ParseKey(petersPublicKey2String)
+	publicKey1 := PublicKey{key1}
+	publicKey2 := PublicKey{key2}
+	presharedKey, _ := wgtypes.GenerateKey()
+	subnet, _ := ParseSubnet("192.168.1.0/24")
+	modified := TimeJ{time.Date(2020, 10, 13, 17, 0, 0, 0, time.UTC)}
+	config1 := ClientConfig{
+		IP:                  net.IPv4(10, 0, 0, 1),
+		IPv6:                net.ParseIP("fd00::1"),
+		Pool:                "staff",
+		Modified:            modified,
+		PresharedKey:        &PresharedKey{presharedKey},
+		AllowedIPs:          []Subnet{subnet},
+		PersistentKeepalive: 25,
+		Expires:             &TimeJ{modified.Add(time.Hour)},
+		Name:                "Phone",
+		Metadata:            map[string]string{"device": "phone"},
+	}
+	config2 := NewClientConfig(net.IPv4(10, 0, 0, 2), net.ParseIP("fd00::2"), DefaultPool)
+	config2.Modified = modified
+
+	// Unknown users have no configs and default settings.
+	if len(storage.GetUserClients(peterUsername)) != 0 || storage.IsDisabled(peterUsername) ||
+		storage.GetDisabledReason(peterUsername) != NotDisabled || storage.GetUserPool(peterUsername) != "" ||
+		storage.GetMaxConfigs(peterUsername) != nil || storage.GetMonthlyQuota(peterUsername) != nil {
+		t.Error("Unknown user does not have default settings")
+	}
+
+	for _, config := range []struct {
+		username  UserID
+		publicKey PublicKey
+		config    ClientConfig
+		exp       bool
+	}{
+		{peterUsername, publicKey1, config1, true},
+		{peterUsername, publicKey2, config2, true},
+		// Addresses which are already used are not saved.
+		{"Emma", publicKey1, NewClientConfig(net.IPv4(10, 0, 0, 3), net.ParseIP("fd00::1"), DefaultPool), false},
+	} {
+		saved, err := storage.UpdateOrCreateConfig(config.username, config.publicKey, config.config, 0)
+		if err != nil {
+			t.Fatalf("Error saving config: %s", err)
+		}
+		if saved != config.exp {
+			t.Errorf("Config %s of %s saved: %t, expected %t", config.publicKey, config.username, saved,
+				config.exp)
+		}
+	}
+
+	// New configs are not saved if the user has the maximum amount of configs, existing configs can be replaced.
+	key3, _ := wgtypes.ParseKey(petersPublicKey3String)
+	config3 := NewClientConfig(net.IPv4(10, 0, 0, 3), net.ParseIP("fd00::3"), DefaultPool)
+	if saved, err := storage.UpdateOrCreateConfig(peterUsername, PublicKey{key3}, config3, 2); saved ||
+		!errors.Is(err, &ConfigLimitReached) {
+		t.Errorf("Config exceeding limit saved: %t, error: %v", saved, err)
+	}
+	if _, err := storage.UpdateOrCreateConfig(peterUsername, publicKey2, config2, 2); err != nil {
+		t.Errorf("Error replacing config of user with maximum amount of configs: %v", err)
+	}
+
+	expClients := map[PublicKey]ClientConfig{publicKey1: config1, publicKey2: config2}
+	if got := storage.GetUserClients(peterUsername); !cmp.Equal(got, expClients) {
+		t.Error("Diff: ", cmp.Diff(expClients, got))
+	}
+	if got := storage.GetAllClients(); !cmp.Equal(got, expClients) {
+		t.Error("Diff: ", cmp.Diff(expClients, got))
+	}
+	expUsernames := map[PublicKey]UserID{publicKey1: peterUsername, publicKey2: peterUsername}
+	if got := storage.GetUsernames(); !cmp.Equal(got, expUsernames) {
+		t.Error("Diff: ", cmp.Diff(expUsernames, got))
+	}
+	username, config, err := storage.GetUsernameAndConfig(publicKey1)
+	if err != nil || username != peterUsername || !cmp.Equal(config, config1) {
+		t.Errorf("Unexpected user %s and config %v of public key: %v", username, config, err)
+	}
+	if _, _, err := storage.GetUsernameAndConfig(PublicKey{}); err == nil {
+		t.Error("Found config of unknown public key")
+	}
+	if got := len(storage.GetAllocatedIPs()); got != 4 {
+		t.Errorf("Got %d allocated addresses, expected 4", got)
+	}
+
+	config, exists, err := storage.UpdateConfig(peterUsername, publicKey1, func(config *ClientConfig) {
+		config.Name = "Laptop"
+	})
+	if err != nil || !exists || config.Name != "Laptop" || storage.GetUserClients(peterUsername)[publicKey1].Name !=
+		"Laptop" {
+		t.Errorf("Config was not updated, exists: %t, error: %v", exists, err)
+	}
+	if _, exists, _ := storage.UpdateConfig("Emma", publicKey1, func(config *ClientConfig) {}); exists {
+		t.Error("Updated config of other user")
+	}
+	err = storage.UpdateConfigs(peterUsername, func(publicKey PublicKey, config *ClientConfig) {
+		config.IP = nil
+		config.IPv6 = nil
+	})
+	if err != nil {
+		t.Fatalf("Error updating configs: %s", err)
+	}
+	if got := len(storage.GetAllocatedIPs()); got != 0 {
+		t.Errorf("Got %d allocated addresses after releasing them", got)
+	}
+	// Released addresses can be used by other configs.
+	if saved, err := storage.UpdateOrCreateConfig("Emma", PublicKey{key3}, config1, 0); !saved || err != nil {
+		t.Errorf("Config with released addresses was not saved: %v", err)
+	}
+	if deleted, err := storage.DeleteConfig("Emma", PublicKey{key3}); !deleted || err != nil {
+		t.Errorf("Config was not deleted: %v", err)
+	}
+
+	deleted, err := storage.DeleteConfig(peterUsername, publicKey2)
+	if err != nil || !deleted {
+		t.Errorf("Config was not deleted: %v", err)
+	}
+	if deleted, _ := storage.DeleteConfig(peterUsername, publicKey2); deleted {
+		t.Error("Deleted config which does not exist")
+	}
+
+	previous, err := storage.SetDisabled(peterUsername, DisabledQuotaExceeded)
+	if err != nil || previous != NotDisabled {
+		t.Errorf("Unexpected previous reason %s: %v", previous, err)
+	}
+	if previous, _ := storage.SetDisabled(peterUsername, DisabledByAdmin); previous != DisabledQuotaExceeded {
+		t.Errorf("Unexpected previous reason %s", previous)
+	}
+	if !storage.IsDisabled(peterUsername) || storage.GetDisabledReason(peterUsername) != DisabledByAdmin {
+		t.Error("User was not disabled")
+	}
+
+	maxConfigs := 5
+	monthlyQuota := int64(1e9)
+	for _, err := range []error{
+		storage.SetUserPool("Emma", "staff"),
+		storage.SetMaxConfigs("Emma", &maxConfigs),
+		storage.SetMonthlyQuota("Emma", &monthlyQuota),
+		storage.SetMonthlyQuota(peterUsername, &monthlyQuota),
+		storage.SetMonthlyQuota(peterUsername, nil),
+	} {
+		if err != nil {
+			t.Fatalf("Error changing settings: %s", err)
+		}
+	}
+	if storage.GetUserPool("Emma") != "staff" || *storage.GetMaxConfigs("Emma") != 5 ||
+		*storage.GetMonthlyQuota("Emma") != monthlyQuota || storage.GetMonthlyQuota(peterUsername) != nil {
+		t.Error("Settings were not changed")
+	}
+
+	expUsers := map[UserID]User{
+		peterUsername: {
+			IsDisabled:     true,
+			DisabledReason: DisabledByAdmin,
+			Clients:        storage.GetUserClients(peterUsername),
+		},
+		"Emma": {
+			Clients:      map[PublicKey]ClientConfig{},
+			Pool:         "staff",
+			MaxConfigs:   &maxConfigs,
+			MonthlyQuota: &monthlyQuota,
+		},
+	}
+	if got := storage.GetAllUsers(); !cmp.Equal(got, expUsers) {
+		t.Error("Diff: ", cmp.Diff(expUsers, got))
+	}
+	if got := storage.GetEnabledUsers(); !cmp.Equal(got, []User{expUsers["Emma"]}) {
+		t.Error("Diff: ", cmp.Diff([]User{expUsers["Emma"]}, got))
+	}
+
+	if writes == 0 {
+		t.Error("Writes were not observed")
+	}
+}
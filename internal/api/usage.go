@@ -0,0 +1,319 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// UsageStorage stores the amount of traffic of every config. The traffic counters of WireGuard are reset when a peer is
+// added again or the interface is restarted, so the usage is calculated from periodic samples of the counters.
+type UsageStorage struct {
+	filePath string
+	mutex    sync.Mutex
+	data     usageData
+}
+
+type usageData struct {
+	Configs map[PublicKey]*ConfigUsage `json:"configs"`
+}
+
+type Usage struct {
+	ReceiveBytes  int64 `json:"receiveBytes"`
+	TransmitBytes int64 `json:"transmitBytes"`
+}
+
+func (u *Usage) add(other Usage) {
+	u.ReceiveBytes += other.ReceiveBytes
+	u.TransmitBytes += other.TransmitBytes
+}
+
+// ConfigUsage contains the traffic of a config. Usage is kept after a config is deleted so the usage of the user does
+// not decrease.
+type ConfigUsage struct {
+	Username UserID `json:"username"`
+	Total    Usage  `json:"total"`
+	// Usage per hour, keys are the start of the hour in RFC 3339 format in UTC.
+	Hourly map[string]Usage `json:"hourly"`
+	// Usage per day, keys are dates in the format YYYY-MM-DD in UTC.
+	Daily map[string]Usage `json:"daily"`
+	// Counters of WireGuard at the previous sample.
+	LastCounters Usage `json:"lastCounters"`
+}
+
+// usageSample contains the counters of a peer read from WireGuard.
+type usageSample struct {
+	username  UserID
+	publicKey PublicKey
+	counters  Usage
+}
+
+const hourlyUsageRetention = 7 * 24 * time.Hour
+const dailyUsageRetention = 400 * 24 * time.Hour
+const hourKeyFormat = time.RFC3339
+const dayKeyFormat = "2006-01-02"
+
+// ReadUsageFile reads usage from a file. If the file does not exist, it will be created when usage is recorded. If the
+// file is corrupt, for example because the disk was full, the backup created by the last write is read instead and the
+// corrupt file is renamed. Without valid backup the recorded usage is lost, so the daemon can still start.
+func ReadUsageFile(filePath string) (*UsageStorage, error) {
+	storage, err := readUsageFile(filePath)
+	var corruptErr *corruptStorageError
+	if !errors.As(err, &corruptErr) {
+		return storage, err
+	}
+	resolvedPath, _, resolveErr := resolveStoragePath(filePath)
+	if resolveErr != nil {
+		return nil, resolveErr
+	}
+	backupPath := resolvedPath + ".bak"
+	storage, backupErr := readUsageFile(backupPath)
+	if backupErr != nil {
+		log.Printf("WARNING: reading usage backup %s failed: %s. Usage is recorded from now on.", backupPath, backupErr)
+		storage = newUsageStorage(filePath)
+	}
+	corruptPath := fmt.Sprintf("%s.corrupt-%d", resolvedPath, time.Now().Unix())
+	if err := os.Rename(resolvedPath, corruptPath); err != nil {
+		return nil, fmt.Errorf("error moving corrupt usage file: %w", err)
+	}
+	storage.filePath = filePath
+	log.Printf("WARNING: %s. Using backup %s, usage recorded after the backup was created is lost. "+
+		"The corrupt file was moved to %s.", err, backupPath, corruptPath)
+	return storage, nil
+}
+
+func newUsageStorage(filePath string) *UsageStorage {
+	return &UsageStorage{
+		filePath: filePath,
+		data: usageData{
+			Configs: map[PublicKey]*ConfigUsage{},
+		},
+	}
+}
+
+func readUsageFile(filePath string) (*UsageStorage, error) {
+	storage := newUsageStorage(filePath)
+	content, err := ioutil.ReadFile(filepath.Clean(filePath))
+	if os.IsNotExist(err) {
+		return storage, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read usage file: %w", err)
+	}
+	if err = json.Unmarshal(content, &storage.data); err != nil {
+		return nil, &corruptStorageError{filePath: filePath, err: err}
+	}
+	return storage, nil
+}
+
+// Mutex should already be locked, we will unlock it before writing everything to disk. Usage is only written by the
+// sampler, so writes can not happen out of order.
+func (u *UsageStorage) write() error {
+	data, err := json.MarshalIndent(u.data, "", "  ")
+	u.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	return writeFileAtomically(u.filePath, data)
+}
+
+// record adds the traffic since the previous samples to the usage of the configs. If a counter is lower than at the
+// previous sample, the counter has been reset and all traffic counted since the reset is added. Configs missing from
+// samples are not in WireGuard, so their counters will start at 0 when they are added again.
+func (u *UsageStorage) record(samples []usageSample, now time.Time) error {
+	u.mutex.Lock()
+
+	sampled := map[PublicKey]bool{}
+	hour := now.UTC().Truncate(time.Hour).Format(hourKeyFormat)
+	day := now.UTC().Format(dayKeyFormat)
+	for _, sample := range samples {
+		sampled[sample.publicKey] = true
+		configUsage := u.data.Configs[sample.publicKey]
+		if configUsage == nil || configUsage.Username != sample.username {
+			configUsage = &ConfigUsage{Username: sample.username}
+			u.data.Configs[sample.publicKey] = configUsage
+		}
+
+		delta := Usage{
+			ReceiveBytes:  counterDelta(configUsage.LastCounters.ReceiveBytes, sample.counters.ReceiveBytes),
+			TransmitBytes: counterDelta(configUsage.LastCounters.TransmitBytes, sample.counters.TransmitBytes),
+		}
+		configUsage.LastCounters = sample.counters
+		if delta == (Usage{}) {
+			continue
+		}
+
+		if configUsage.Hourly == nil {
+			configUsage.Hourly = map[string]Usage{}
+		}
+		if configUsage.Daily == nil {
+			configUsage.Daily = map[string]Usage{}
+		}
+		configUsage.Total.add(delta)
+		hourly := configUsage.Hourly[hour]
+		hourly.add(delta)
+		configUsage.Hourly[hour] = hourly
+		daily := configUsage.Daily[day]
+		daily.add(delta)
+		configUsage.Daily[day] = daily
+	}
+
+	for publicKey, configUsage := range u.data.Configs {
+		if !sampled[publicKey] {
+			configUsage.LastCounters = Usage{}
+		}
+		pruneUsage(configUsage.Hourly, hourKeyFormat, now.Add(-hourlyUsageRetention))
+		pruneUsage(configUsage.Daily, dayKeyFormat, now.Add(-dailyUsageRetention))
+	}
+
+	return u.write()
+}
+
+func counterDelta(last int64, current int64) int64 {
+	if current < last {
+		return current
+	}
+	return current - last
+}
+
+// pruneUsage removes buckets which started before oldest.
+func pruneUsage(buckets map[string]Usage, format string, oldest time.Time) {
+	for key := range buckets {
+		start, err := time.Parse(format, key)
+		if err != nil || start.Before(oldest) {
+			delete(buckets, key)
+		}
+	}
+}
+
+// UsageReport contains the total traffic and the traffic per hour and per day.
+type UsageReport struct {
+	Total  Usage            `json:"total"`
+	Hourly map[string]Usage `json:"hourly"`
+	Daily  map[string]Usage `json:"daily"`
+}
+
+func newUsageReport() UsageReport {
+	return UsageReport{
+		Hourly: map[string]Usage{},
+		Daily:  map[string]Usage{},
+	}
+}
+
+func (r *UsageReport) add(configUsage *ConfigUsage) {
+	r.Total.add(configUsage.Total)
+	for hour, usage := range configUsage.Hourly {
+		hourly := r.Hourly[hour]
+		hourly.add(usage)
+		r.Hourly[hour] = hourly
+	}
+	for day, usage := range configUsage.Daily {
+		daily := r.Daily[day]
+		daily.add(usage)
+		r.Daily[day] = daily
+	}
+}
+
+// UserUsageReport contains the traffic of all configs of a user, including deleted configs, and the total traffic of
+// every config.
+type UserUsageReport struct {
+	UsageReport
+	Configs map[PublicKey]Usage `json:"configs"`
+}
+
+// GetUserUsage returns the usage of all configs of a user, including deleted configs.
+func (u *UsageStorage) GetUserUsage(username UserID) UserUsageReport {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	report := UserUsageReport{
+		UsageReport: newUsageReport(),
+		Configs:     map[PublicKey]Usage{},
+	}
+	for publicKey, configUsage := range u.data.Configs {
+		if configUsage.Username == username {
+			report.add(configUsage)
+			report.Configs[publicKey] = configUsage.Total
+		}
+	}
+	return report
+}
+
+// GetUserUsageSince returns the usage of all configs of a user since the start of the day of since in UTC.
+func (u *UsageStorage) GetUserUsageSince(username UserID, since time.Time) Usage {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	firstDay := since.UTC().Format(dayKeyFormat)
+	usage := Usage{}
+	for _, configUsage := range u.data.Configs {
+		if configUsage.Username != username {
+			continue
+		}
+		for day, dailyUsage := range configUsage.Daily {
+			// Dates in the format YYYY-MM-DD can be compared as strings.
+			if day >= firstDay {
+				usage.add(dailyUsage)
+			}
+		}
+	}
+	return usage
+}
+
+// GetConfigUsage returns the usage of a config of a user, an empty report if no usage has been recorded.
+func (u *UsageStorage) GetConfigUsage(username UserID, publicKey PublicKey) UsageReport {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	report := newUsageReport()
+	if configUsage := u.data.Configs[publicKey]; configUsage != nil && configUsage.Username == username {
+		report.add(configUsage)
+	}
+	return report
+}
+
+func (s *Server) sampleUsagePeriodically() {
+	ticker := time.NewTicker(s.usageSampleInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case now := <-ticker.C:
+			if err := s.sampleUsage(now); err != nil {
+				log.Print("Error recording usage: ", err)
+			}
+			s.enforceQuotas(now)
+		}
+	}
+}
+
+// sampleUsage reads the traffic counters of all peers in WireGuard and records the traffic of the configs.
+func (s *Server) sampleUsage(now time.Time) error {
+	peers, err := s.wgManager.GetPeers()
+	if err != nil {
+		return fmt.Errorf("error getting WireGuard peers: %w", err)
+	}
+
+	usernames := s.Storage.GetUsernames()
+	var samples []usageSample
+	for _, peer := range peers {
+		publicKey := PublicKey{peer.PublicKey}
+		username, exists := usernames[publicKey]
+		if !exists {
+			continue
+		}
+		samples = append(samples, usageSample{
+			username:  username,
+			publicKey: publicKey,
+			counters:  Usage{ReceiveBytes: peer.ReceiveBytes, TransmitBytes: peer.TransmitBytes},
+		})
+	}
+	return s.usage.record(samples, now)
+}
@@ -0,0 +1,213 @@
+package api
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func newTestUsageStorage() *UsageStorage {
+	return newUsageStorage(filepath.Join(testStorageDir, "usage.json"))
+}
+
+func TestRecordUsage(t *testing.T) {
+	petersPublicKey1, _ := wgtypes.ParseKey(petersPublicKey1String)
+	petersPublicKey2, _ := wgtypes.ParseKey(petersPublicKey2String)
+	publicKey1 := PublicKey{petersPublicKey1}
+	publicKey2 := PublicKey{petersPublicKey2}
+	storage := newTestUsageStorage()
+
+	t1 := time.Date(2020, 10, 13, 17, 10, 0, 0, time.UTC)
+	t2 := t1.Add(30 * time.Minute)
+	t3 := t1.Add(24 * time.Hour)
+	t4 := t3.Add(time.Hour)
+	t5 := t4.Add(time.Hour)
+
+	var samples = []struct {
+		now     time.Time
+		samples []usageSample
+	}{
+		{t1, []usageSample{
+			{peterUsername, publicKey1, Usage{100, 10}},
+			{peterUsername, publicKey2, Usage{5, 5}},
+		}},
+		{t2, []usageSample{
+			{peterUsername, publicKey1, Usage{150, 30}},
+			{peterUsername, publicKey2, Usage{5, 5}},
+		}},
+		// The counters were reset.
+		{t3, []usageSample{
+			{peterUsername, publicKey1, Usage{40, 4}},
+		}},
+		// The config was removed from WireGuard, the counters start at 0 when it is added again.
+		{t4, []usageSample{}},
+		{t5, []usageSample{
+			{peterUsername, publicKey1, Usage{60, 6}},
+		}},
+	}
+	for _, sample := range samples {
+		if err := storage.record(sample.samples, sample.now); err != nil {
+			t.Fatalf("Error recording usage: %s", err)
+		}
+	}
+
+	exp := UserUsageReport{
+		UsageReport: UsageReport{
+			Total: Usage{255, 45},
+			Hourly: map[string]Usage{
+				"2020-10-13T17:00:00Z": {155, 35},
+				"2020-10-14T17:00:00Z": {40, 4},
+				"2020-10-14T19:00:00Z": {60, 6},
+			},
+			Daily: map[string]Usage{
+				"2020-10-13": {155, 35},
+				"2020-10-14": {100, 10},
+			},
+		},
+		Configs: map[PublicKey]Usage{
+			publicKey1: {250, 40},
+			publicKey2: {5, 5},
+		},
+	}
+	if got := storage.GetUserUsage(peterUsername); !cmp.Equal(got, exp) {
+		t.Error("Diff: ", cmp.Diff(exp, got))
+	}
+
+	expConfig := UsageReport{
+		Total:  Usage{5, 5},
+		Hourly: map[string]Usage{"2020-10-13T17:00:00Z": {5, 5}},
+		Daily:  map[string]Usage{"2020-10-13": {5, 5}},
+	}
+	if got := storage.GetConfigUsage(peterUsername, publicKey2); !cmp.Equal(got, expConfig) {
+		t.Error("Diff: ", cmp.Diff(expConfig, got))
+	}
+	if got := storage.GetConfigUsage("Nick", publicKey2); !cmp.Equal(got, newUsageReport()) {
+		t.Errorf("Got usage of config of other user: %v", got)
+	}
+
+	// Old hourly usage is removed, the total is kept.
+	if err := storage.record(nil, t5.Add(hourlyUsageRetention-time.Hour)); err != nil {
+		t.Fatalf("Error recording usage: %s", err)
+	}
+	got := storage.GetUserUsage(peterUsername)
+	if len(got.Hourly) != 1 || len(got.Daily) != 2 || got.Total != exp.Total {
+		t.Errorf("Unexpected usage after pruning: %v", got)
+	}
+}
+
+func TestGetUsage(t *testing.T) {
+	setup()
+	petersPublicKey1, _ := wgtypes.ParseKey(petersPublicKey1String)
+	server.wgManager = TestWGManager{
+		getPeersPeerList: []wgtypes.Peer{
+			{PublicKey: petersPublicKey1, ReceiveBytes: 9, TransmitBytes: 2},
+			{PublicKey: wgtypes.Key{}, ReceiveBytes: 1, TransmitBytes: 1},
+		},
+	}
+
+	parameters := url.Values{"user_id": {peterUsername}}
+	req, _ := http.NewRequest(http.MethodGet, "/usage?"+parameters.Encode(), nil)
+	respRec := httptest.NewRecorder()
+	apiRouter.ServeHTTP(respRec, req)
+	testError(t, *respRec, &UsageUnavailable)
+
+	server.usage = newTestUsageStorage()
+	now := time.Date(2020, 10, 13, 17, 10, 0, 0, time.UTC)
+	if err := server.sampleUsage(now); err != nil {
+		t.Fatalf("Error sampling usage: %s", err)
+	}
+
+	var tests = []struct {
+		parameters url.Values
+		apiError   *Error
+		exp        string
+	}{
+		{url.Values{"user_id": {peterUsername}}, nil, `{"total":{"receiveBytes":9,"transmitBytes":2},` +
+			`"hourly":{"2020-10-13T17:00:00Z":{"receiveBytes":9,"transmitBytes":2}},` +
+			`"daily":{"2020-10-13":{"receiveBytes":9,"transmitBytes":2}},` +
+			`"configs":{"` + petersPublicKey1String + `":{"receiveBytes":9,"transmitBytes":2}}}`},
+		{url.Values{"user_id": {peterUsername}, "public_key": {petersPublicKey2String}}, nil,
+			`{"total":{"receiveBytes":0,"transmitBytes":0},"hourly":{},"daily":{}}`},
+		{url.Values{"user_id": {"Nick"}}, nil,
+			`{"total":{"receiveBytes":0,"transmitBytes":0},"hourly":{},"daily":{},"configs":{}}`},
+		{url.Values{"user_id": {peterUsername}, "public_key": {"invalid"}}, &InvalidPublicKey, ""},
+	}
+
+	for _, test := range tests {
+		req, _ := http.NewRequest(http.MethodGet, "/usage?"+test.parameters.Encode(), nil)
+		respRec := httptest.NewRecorder()
+		apiRouter.ServeHTTP(respRec, req)
+
+		testError(t, *respRec, test.apiError)
+		if test.apiError != nil {
+			continue
+		}
+		var got, exp interface{}
+		if err := json.Unmarshal(respRec.Body.Bytes(), &got); err != nil {
+			t.Errorf("Error decoding JSON: %s", err)
+		}
+		_ = json.Unmarshal([]byte(test.exp), &exp)
+		if !cmp.Equal(got, exp) {
+			t.Error("Diff: ", cmp.Diff(exp, got))
+		}
+	}
+}
+
+func TestReadCorruptUsageFile(t *testing.T) {
+	dir, cleanup := newTestStorageDir(t)
+	defer cleanup()
+	filePath := filepath.Join(dir, "usage.json")
+	petersPublicKey1, _ := wgtypes.ParseKey(petersPublicKey1String)
+	publicKey := PublicKey{petersPublicKey1}
+	now := time.Date(2020, 10, 13, 17, 10, 0, 0, time.UTC)
+
+	storage, err := ReadUsageFile(filePath)
+	if err != nil {
+		t.Fatalf("Error reading usage: %s", err)
+	}
+	for _, receiveBytes := range []int64{100, 300} {
+		samples := []usageSample{{peterUsername, publicKey, Usage{ReceiveBytes: receiveBytes}}}
+		if err := storage.record(samples, now); err != nil {
+			t.Fatalf("Error recording usage: %s", err)
+		}
+	}
+	// A write was interrupted.
+	if err := ioutil.WriteFile(filePath, []byte(`{"configs": {"1+Pet`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	storage, err = ReadUsageFile(filePath)
+	if err != nil {
+		t.Fatalf("Error reading usage: %s", err)
+	}
+	if storage.data.Configs[publicKey] == nil {
+		t.Error("Backup was not used")
+	}
+	corruptFiles, _ := filepath.Glob(filePath + ".corrupt-*")
+	if len(corruptFiles) != 1 {
+		t.Errorf("Expected 1 corrupt file, got %v", corruptFiles)
+	}
+
+	// Without valid backup the daemon starts without usage.
+	if err := ioutil.WriteFile(filePath+".bak", []byte{}, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filePath, []byte{}, 0600); err != nil {
+		t.Fatal(err)
+	}
+	storage, err = ReadUsageFile(filePath)
+	if err != nil {
+		t.Fatalf("Error reading usage: %s", err)
+	}
+	if len(storage.data.Configs) != 0 {
+		t.Errorf("Unexpected usage: %v", storage.data.Configs)
+	}
+}
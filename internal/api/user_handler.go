@@ -2,11 +2,17 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
 	"net"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/fantostisch/wireguard-daemon/wgmanager"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
 type UserHandler struct {
@@ -17,7 +23,7 @@ type UserHandler struct {
 func (h UserHandler) getConfigs(w http.ResponseWriter, username UserID) {
 	clients := h.Server.Storage.GetUserClients(username)
 
-	if err := json.NewEncoder(w).Encode(clients); err != nil {
+	if err := json.NewEncoder(w).Encode(withoutSecrets(clients)); err != nil {
 		message := fmt.Sprintf("Error encoding response as JSON: %s", err)
 		http.Error(w, message, http.StatusInternalServerError)
 		return
@@ -28,42 +34,159 @@ type createConfigAndKeyPairResponse struct {
 	ClientPrivateKey PrivateKey `json:"clientPrivateKey"`
 	ClientPublicKey  PublicKey  `json:"clientPublicKey"`
 	IP               net.IP     `json:"ip"`
+	IPv6             net.IP     `json:"ipv6"`
 	ServerPublicKey  PublicKey  `json:"serverPublicKey"`
+	ClientConfig     string     `json:"clientConfig,omitempty"`
+	// Only returned when the preshared key is created.
+	PresharedKey *PresharedKey `json:"presharedKey,omitempty"`
 }
 
 type createConfigResponse struct {
 	IP              net.IP    `json:"ip"`
+	IPv6            net.IP    `json:"ipv6"`
 	ServerPublicKey PublicKey `json:"serverPublicKey"`
+	ClientConfig    string    `json:"clientConfig,omitempty"`
+	// Only returned when the preshared key is created.
+	PresharedKey *PresharedKey `json:"presharedKey,omitempty"`
+	config       ClientConfig
 }
 
-func (h UserHandler) newConfig(username UserID, publicKey PublicKey) (createConfigResponse, error) {
+// createConfigOptions contains the optional settings of a new config.
+type createConfigOptions struct {
+	// Pool the addresses are allocated from. If empty, the default pool of the user is used.
+	pool string
+	// Add a wg-quick configuration file to the response.
+	includeClientConfig bool
+	// Create a preshared key for the config.
+	presharedKey bool
+	// Networks routed to the client in addition to its addresses.
+	allowedIPs []Subnet
+	// Interval in seconds in which keepalive packets are sent to the client, 0 means disabled.
+	persistentKeepalive int
+	// Time after which the config can no longer be used, nil if the config does not expire.
+	expires  *TimeJ
+	name     string
+	metadata map[string]string
+}
+
+// newConfig creates a config with addresses from the pool in options.
+func (h UserHandler) newConfig(username UserID, publicKey PublicKey,
+	options createConfigOptions) (createConfigResponse, error) {
+
+	var presharedKey *PresharedKey
+	if options.presharedKey {
+		key, err := h.Server.wgManager.GeneratePresharedKey()
+		if err != nil {
+			return createConfigResponse{}, fmt.Errorf("error generating preshared key: %w", err)
+		}
+		presharedKey = &key
+	}
+
+	pool := options.pool
+	if pool == "" {
+		pool = h.Server.Storage.GetUserPool(username)
+	}
+	if pool == "" {
+		pool = DefaultPool
+	}
+
+	// Disabled users do not get addresses if they would be released when the user was disabled.
+	if h.Server.disabledUserIPPolicy == ReleaseIPs && h.Server.Storage.IsDisabled(username) {
+		return createConfigResponse{}, &UserDisabled
+	}
+
+	oldConfig, overwritten := h.Server.Storage.GetUserClients(username)[publicKey]
+	maxConfigs := h.Server.getMaxConfigs(username)
+
 	var config ClientConfig
 
 	for {
-		ip, noIPAvailableError := h.Server.allocateIP()
-		if ip == nil || noIPAvailableError != nil {
-			return createConfigResponse{}, noIPAvailableError
+		ip, ipv6, allocationError := h.Server.allocateIPs(pool)
+		if ip == nil || ipv6 == nil || allocationError != nil {
+			return createConfigResponse{}, allocationError
 		}
-		config = NewClientConfig(ip)
-		success, err := h.Server.Storage.UpdateOrCreateConfig(username, publicKey, config)
+		config = NewClientConfig(ip, ipv6, pool)
+		config.PresharedKey = presharedKey
+		config.AllowedIPs = options.allowedIPs
+		config.PersistentKeepalive = options.persistentKeepalive
+		config.Expires = options.expires
+		config.Name = options.name
+		config.Metadata = options.metadata
+		success, err := h.Server.Storage.UpdateOrCreateConfig(username, publicKey, config, maxConfigs)
 		if err != nil {
+			h.Server.releaseIPs(config)
+			if errors.Is(err, &ConfigLimitReached) {
+				return createConfigResponse{}, err
+			}
 			return createConfigResponse{}, fmt.Errorf("error saving config: %w", err)
 		}
-		if err := h.Server.wgManager.AddPeers([]wgmanager.Peer{ClientToWGPeer(publicKey, config)}); err != nil {
-			return createConfigResponse{}, fmt.Errorf("error adding peer to WireGuard: %w", err)
+		if !success {
+			// The addresses are used by another config, try the next addresses.
+			continue
 		}
-		if success {
+		if !h.Server.isPeerActive(username, config) {
+			// The config is added to WireGuard when the user is enabled.
 			break
 		}
+		if err := h.Server.wgManager.AddPeers([]wgmanager.Peer{ClientToWGPeer(publicKey, config)}); err != nil {
+			h.restoreConfig(username, publicKey, oldConfig, overwritten)
+			h.Server.releaseIPs(config)
+			return createConfigResponse{}, fmt.Errorf("error adding peer to WireGuard: %w", err)
+		}
+		break
+	}
+
+	if overwritten {
+		h.Server.releaseIPs(oldConfig)
 	}
 
 	return createConfigResponse{
 		IP:              config.IP,
+		IPv6:            config.IPv6,
 		ServerPublicKey: h.Server.GetPublicKey(),
+		PresharedKey:    presharedKey,
+		config:          config,
 	}, nil
 }
 
-func (h UserHandler) createConfigGenerateKeyPair(w http.ResponseWriter, username UserID) {
+// restoreConfig undoes saving a new config after it could not be added to WireGuard, by restoring the overwritten
+// config or deleting the new config.
+func (h UserHandler) restoreConfig(username UserID, publicKey PublicKey, oldConfig ClientConfig, overwritten bool) {
+	var err error
+	if overwritten {
+		_, _, err = h.Server.Storage.UpdateConfig(username, publicKey, func(config *ClientConfig) {
+			*config = oldConfig
+		})
+	} else {
+		_, err = h.Server.Storage.DeleteConfig(username, publicKey)
+	}
+	if err != nil {
+		log.Printf("Error restoring config of %s after adding it to WireGuard failed: %s", username, err)
+	}
+}
+
+func replyWithCreateConfigError(w http.ResponseWriter, err error, pool string) {
+	switch err.Error() {
+	case NoIPAvailable.Error():
+		replyWithError(w, NoIPAvailable, "Could not create config.")
+	case UnknownPool.Error():
+		replyWithError(w, UnknownPool, fmt.Sprintf("Pool '%s' does not exist.", pool))
+	case ConfigLimitReached.Error():
+		replyWithError(w, ConfigLimitReached, "Could not create config, the user has the maximum amount of configs.")
+	case UserDisabled.Error():
+		replyWithError(w, UserDisabled, "Could not create config, the user is disabled.")
+	default:
+		message := fmt.Sprintf("Error creating config: %s", err)
+		http.Error(w, message, http.StatusInternalServerError)
+	}
+}
+
+func (h UserHandler) createConfigGenerateKeyPair(w http.ResponseWriter, username UserID,
+	options createConfigOptions) {
+
+	if options.includeClientConfig && !h.checkClientConfigAvailable(w) {
+		return
+	}
 	clientPrivateKey, err := h.Server.wgManager.GeneratePrivateKey()
 	if err != nil {
 		message := fmt.Sprintf("Error generating private key: %s", err)
@@ -71,14 +194,12 @@ func (h UserHandler) createConfigGenerateKeyPair(w http.ResponseWriter, username
 		return
 	}
 	clientPublicKey := clientPrivateKey.PublicKey()
-	createConfigResponse, err := h.newConfig(username, clientPublicKey)
+	if !h.checkAllowedIPs(w, clientPublicKey, options.allowedIPs) {
+		return
+	}
+	createConfigResponse, err := h.newConfig(username, clientPublicKey, options)
 	if err != nil {
-		if err.Error() == NoIPAvailable.Error() {
-			replyWithError(w, NoIPAvailable, "Could not create config.")
-		} else {
-			message := fmt.Sprintf("Error creating config: %s", err)
-			http.Error(w, message, http.StatusInternalServerError)
-		}
+		replyWithCreateConfigError(w, err, options.pool)
 		return
 	}
 
@@ -86,7 +207,12 @@ func (h UserHandler) createConfigGenerateKeyPair(w http.ResponseWriter, username
 		ClientPrivateKey: clientPrivateKey,
 		ClientPublicKey:  clientPublicKey,
 		IP:               createConfigResponse.IP,
+		IPv6:             createConfigResponse.IPv6,
 		ServerPublicKey:  createConfigResponse.ServerPublicKey,
+		PresharedKey:     createConfigResponse.PresharedKey,
+	}
+	if options.includeClientConfig {
+		response.ClientConfig = h.Server.renderClientConfig(createConfigResponse.config, &clientPrivateKey)
 	}
 
 	if err := json.NewEncoder(w).Encode(response); err != nil {
@@ -96,17 +222,23 @@ func (h UserHandler) createConfigGenerateKeyPair(w http.ResponseWriter, username
 	}
 }
 
-func (h UserHandler) createConfig(w http.ResponseWriter, username UserID, publicKey PublicKey) {
-	response, err := h.newConfig(username, publicKey)
+func (h UserHandler) createConfig(w http.ResponseWriter, username UserID, publicKey PublicKey,
+	options createConfigOptions) {
+
+	if options.includeClientConfig && !h.checkClientConfigAvailable(w) {
+		return
+	}
+	if !h.checkAllowedIPs(w, publicKey, options.allowedIPs) {
+		return
+	}
+	response, err := h.newConfig(username, publicKey, options)
 	if err != nil {
-		if err.Error() == NoIPAvailable.Error() {
-			replyWithError(w, NoIPAvailable, "Could not create config.")
-		} else {
-			message := fmt.Sprintf("Error creating config: %s", err)
-			http.Error(w, message, http.StatusInternalServerError)
-		}
+		replyWithCreateConfigError(w, err, options.pool)
 		return
 	}
+	if options.includeClientConfig {
+		response.ClientConfig = h.Server.renderClientConfig(response.config, nil)
+	}
 
 	if err := json.NewEncoder(w).Encode(response); err != nil {
 		message := fmt.Sprintf("Error encoding response as JSON: %s", err)
@@ -115,7 +247,103 @@ func (h UserHandler) createConfig(w http.ResponseWriter, username UserID, public
 	}
 }
 
+// checkAllowedIPs replies with an error and returns false if the networks overlap with other networks.
+func (h UserHandler) checkAllowedIPs(w http.ResponseWriter, publicKey PublicKey, allowedIPs []Subnet) bool {
+	if err := h.Server.checkAllowedIPs(publicKey, allowedIPs); err != nil {
+		replyWithError(w, AllowedIPsOverlap, fmt.Sprintf("Invalid allowed IPs: %s", err))
+		return false
+	}
+	return true
+}
+
+// checkClientConfigAvailable replies with an error and returns false if client configuration files can not be created.
+func (h UserHandler) checkClientConfigAvailable(w http.ResponseWriter) bool {
+	if h.Server.clientConfigTemplate.Endpoint == "" {
+		replyWithError(w, ClientConfigUnavailable, "The endpoint of the server is not configured.")
+		return false
+	}
+	return true
+}
+
+// clientConfigOrReplyError returns a wg-quick configuration file for a config. If privateKeyString is empty, the
+// configuration file does not contain the private key. If the configuration file can not be created an error response
+// is written and false is returned.
+func (h UserHandler) clientConfigOrReplyError(w http.ResponseWriter, username UserID, publicKey PublicKey,
+	privateKeyString string) (string, bool) {
+
+	if !h.checkClientConfigAvailable(w) {
+		return "", false
+	}
+	config, exists := h.Server.Storage.GetUserClients(username)[publicKey]
+	if !exists {
+		message := fmt.Sprintf(
+			"Config not found: User '%s' does not have a config with public key '%s'", username, publicKey.String())
+		replyWithError(w, ConfigNotFound, message)
+		return "", false
+	}
+
+	var privateKey *PrivateKey
+	if privateKeyString != "" {
+		key, err := wgtypes.ParseKey(privateKeyString)
+		if err != nil {
+			replyWithError(w, InvalidPrivateKey, fmt.Sprintf("Invalid private key. %s", err))
+			return "", false
+		}
+		privateKey = &PrivateKey{key}
+		if privateKey.PublicKey() != publicKey {
+			replyWithError(w, InvalidPrivateKey, "The private key does not belong to the public key.")
+			return "", false
+		}
+	}
+
+	return h.Server.renderClientConfig(config, privateKey), true
+}
+
+// getClientConfig replies with a wg-quick configuration file for a config.
+func (h UserHandler) getClientConfig(w http.ResponseWriter, username UserID, publicKey PublicKey,
+	privateKeyString string) {
+
+	clientConfig, ok := h.clientConfigOrReplyError(w, username, publicKey, privateKeyString)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if _, err := w.Write([]byte(clientConfig)); err != nil {
+		log.Print("Error writing client config: ", err)
+	}
+}
+
+// getClientConfigQRCode replies with a QR code containing the wg-quick configuration file of a config, so it can be
+// imported by scanning it. The private key is required because the configuration file can not be completed later.
+func (h UserHandler) getClientConfigQRCode(w http.ResponseWriter, username UserID, publicKey PublicKey,
+	privateKeyString string, format QRCodeFormat) {
+
+	if _, valid := qrCodeContentTypes[format]; !valid {
+		message := fmt.Sprintf("Invalid format: '%s'. Must be one of png, svg or text.", format)
+		replyWithError(w, InvalidQRCodeFormat, message)
+		return
+	}
+	clientConfig, ok := h.clientConfigOrReplyError(w, username, publicKey, privateKeyString)
+	if !ok {
+		return
+	}
+
+	qrCode, err := renderQRCode(clientConfig, format)
+	if err != nil {
+		message := fmt.Sprintf("Error creating QR code: %s", err)
+		http.Error(w, message, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", qrCodeContentTypes[format])
+	if _, err := w.Write(qrCode); err != nil {
+		log.Print("Error writing QR code: ", err)
+	}
+}
+
 func (h UserHandler) deleteConfig(w http.ResponseWriter, username UserID, publicKey PublicKey) {
+	config := h.Server.Storage.GetUserClients(username)[publicKey]
 	deleted, err := h.Server.Storage.DeleteConfig(username, publicKey)
 	if err != nil {
 		message := fmt.Sprintf("Error deleting config: %s", err)
@@ -129,6 +357,7 @@ func (h UserHandler) deleteConfig(w http.ResponseWriter, username UserID, public
 		replyWithError(w, ConfigNotFound, message)
 		return
 	}
+	h.Server.releaseIPs(config)
 
 	if err := h.Server.wgManager.RemovePeers([]PublicKey{publicKey}); err != nil {
 		message := fmt.Sprintf("Error removing peer from WireGuard: %s", err)
@@ -139,48 +368,294 @@ func (h UserHandler) deleteConfig(w http.ResponseWriter, username UserID, public
 	w.WriteHeader(http.StatusOK)
 }
 
-func (h UserHandler) setDisabledHTTP(w http.ResponseWriter, username UserID, disabled bool,
-	apiError Error, conflictMessage string) {
+type rotatePresharedKeyResponse struct {
+	PresharedKey PresharedKey `json:"presharedKey"`
+}
 
-	valueChanged, err := h.Server.Storage.SetDisabled(username, disabled)
+// rotatePresharedKey replaces the preshared key of a config with a new preshared key, the addresses of the config do
+// not change. A config without preshared key gets one.
+func (h UserHandler) rotatePresharedKey(w http.ResponseWriter, username UserID, publicKey PublicKey) {
+	presharedKey, err := h.Server.wgManager.GeneratePresharedKey()
 	if err != nil {
-		message := fmt.Sprintf("Error enabling/disabling user: %s", err)
+		message := fmt.Sprintf("Error generating preshared key: %s", err)
 		http.Error(w, message, http.StatusInternalServerError)
 		return
 	}
-	if !valueChanged {
-		replyWithError(w, apiError, conflictMessage)
+
+	config, updated, err := h.Server.Storage.UpdateConfig(username, publicKey, func(config *ClientConfig) {
+		config.PresharedKey = &presharedKey
+	})
+	if err != nil {
+		message := fmt.Sprintf("Error saving preshared key: %s", err)
+		http.Error(w, message, http.StatusInternalServerError)
+		return
+	}
+	if !updated {
+		message := fmt.Sprintf(
+			"Config not found: User '%s' does not have a config with public key '%s'", username, publicKey.String())
+		replyWithError(w, ConfigNotFound, message)
 		return
 	}
 
-	clients := h.Server.Storage.GetUserClients(username)
-	if disabled {
-		var publicKeys []PublicKey
-		for publicKey := range clients {
-			publicKeys = append(publicKeys, publicKey)
-		}
-		err = h.Server.wgManager.RemovePeers(publicKeys)
-	} else {
-		var wgPeers []wgmanager.Peer
-		for publicKey, config := range clients {
-			wgPeers = append(wgPeers, ClientToWGPeer(publicKey, config))
+	if h.Server.isPeerActive(username, config) {
+		if err := h.Server.wgManager.AddPeers([]wgmanager.Peer{ClientToWGPeer(publicKey, config)}); err != nil {
+			message := fmt.Sprintf("Error reconfiguring WireGuard: %s", err)
+			http.Error(w, message, http.StatusInternalServerError)
+			return
 		}
-		err = h.Server.wgManager.AddPeers(wgPeers)
 	}
+
+	if err := json.NewEncoder(w).Encode(rotatePresharedKeyResponse{PresharedKey: presharedKey}); err != nil {
+		message := fmt.Sprintf("Error encoding response as JSON: %s", err)
+		http.Error(w, message, http.StatusInternalServerError)
+		return
+	}
+}
+
+// renameConfig changes the name of a config.
+func (h UserHandler) renameConfig(w http.ResponseWriter, username UserID, publicKey PublicKey, name string) {
+	_, updated, err := h.Server.Storage.UpdateConfig(username, publicKey, func(config *ClientConfig) {
+		config.Name = name
+	})
 	if err != nil {
-		message := fmt.Sprintf("Error reconfiguring WireGuard: %s", err)
+		message := fmt.Sprintf("Error saving config: %s", err)
 		http.Error(w, message, http.StatusInternalServerError)
 		return
 	}
+	if !updated {
+		message := fmt.Sprintf(
+			"Config not found: User '%s' does not have a config with public key '%s'", username, publicKey.String())
+		replyWithError(w, ConfigNotFound, message)
+		return
+	}
 
 	w.WriteHeader(http.StatusOK)
 }
 
-//todo: disabling a user does not free its ip addresses, a malicious user can claim all ip addresses
+// setConfigRouting sets the networks routed to a config in addition to its addresses and the keepalive interval.
+func (h UserHandler) setConfigRouting(w http.ResponseWriter, username UserID, publicKey PublicKey,
+	allowedIPs []Subnet, persistentKeepalive int) {
+
+	if !h.checkAllowedIPs(w, publicKey, allowedIPs) {
+		return
+	}
+
+	config, updated, err := h.Server.Storage.UpdateConfig(username, publicKey, func(config *ClientConfig) {
+		config.AllowedIPs = allowedIPs
+		config.PersistentKeepalive = persistentKeepalive
+	})
+	if err != nil {
+		message := fmt.Sprintf("Error saving config: %s", err)
+		http.Error(w, message, http.StatusInternalServerError)
+		return
+	}
+	if !updated {
+		message := fmt.Sprintf(
+			"Config not found: User '%s' does not have a config with public key '%s'", username, publicKey.String())
+		replyWithError(w, ConfigNotFound, message)
+		return
+	}
+
+	if h.Server.isPeerActive(username, config) {
+		if err := h.Server.wgManager.AddPeers([]wgmanager.Peer{ClientToWGPeer(publicKey, config)}); err != nil {
+			message := fmt.Sprintf("Error reconfiguring WireGuard: %s", err)
+			http.Error(w, message, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// checkUsageAvailable replies with an error and returns false if traffic accounting is disabled.
+func (h UserHandler) checkUsageAvailable(w http.ResponseWriter) bool {
+	if h.Server.usage == nil {
+		replyWithError(w, UsageUnavailable, "Traffic accounting is disabled.")
+		return false
+	}
+	return true
+}
+
+// getUserUsage replies with the traffic of all configs of a user, including deleted configs.
+func (h UserHandler) getUserUsage(w http.ResponseWriter, username UserID) {
+	if !h.checkUsageAvailable(w) {
+		return
+	}
+	if err := json.NewEncoder(w).Encode(h.Server.usage.GetUserUsage(username)); err != nil {
+		message := fmt.Sprintf("Error encoding response as JSON: %s", err)
+		http.Error(w, message, http.StatusInternalServerError)
+		return
+	}
+}
+
+// getConfigUsage replies with the traffic of a config, the config may have been deleted.
+func (h UserHandler) getConfigUsage(w http.ResponseWriter, username UserID, publicKey PublicKey) {
+	if !h.checkUsageAvailable(w) {
+		return
+	}
+	if err := json.NewEncoder(w).Encode(h.Server.usage.GetConfigUsage(username, publicKey)); err != nil {
+		message := fmt.Sprintf("Error encoding response as JSON: %s", err)
+		http.Error(w, message, http.StatusInternalServerError)
+		return
+	}
+}
+
+// disableUser disables a user and removes the configs of the user from WireGuard. A user disabled because of the quota
+// of the user is then no longer enabled automatically.
 func (h UserHandler) disableUser(w http.ResponseWriter, username UserID) {
-	h.setDisabledHTTP(w, username, true, UserAlreadyDisabled, fmt.Sprintf("User %s was already disabled.", username))
+	changed, err := h.Server.disableUser(username, DisabledByAdmin)
+	if err != nil {
+		message := fmt.Sprintf("Error disabling user: %s", err)
+		http.Error(w, message, http.StatusInternalServerError)
+		return
+	}
+	if !changed {
+		replyWithError(w, UserAlreadyDisabled, fmt.Sprintf("User %s was already disabled.", username))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
 }
 
+// enableUser enables a user, adds the configs of the user to WireGuard and replies with the configs.
 func (h UserHandler) enableUser(w http.ResponseWriter, username UserID) {
-	h.setDisabledHTTP(w, username, false, UserAlreadyEnabled, fmt.Sprintf("User %s was already enabled.", username))
+	changed, err := h.Server.enableUser(username)
+	if err != nil {
+		switch err.Error() {
+		case NoIPAvailable.Error():
+			replyWithError(w, NoIPAvailable, "Could not assign addresses to the configs of the user.")
+			return
+		case UnknownPool.Error():
+			replyWithError(w, UnknownPool, "The pool of a config of the user does not exist.")
+			return
+		}
+		message := fmt.Sprintf("Error enabling user: %s", err)
+		http.Error(w, message, http.StatusInternalServerError)
+		return
+	}
+	if !changed {
+		replyWithError(w, UserAlreadyEnabled, fmt.Sprintf("User %s was already enabled.", username))
+		return
+	}
+
+	clients := h.Server.Storage.GetUserClients(username)
+	if err := json.NewEncoder(w).Encode(withoutSecrets(clients)); err != nil {
+		message := fmt.Sprintf("Error encoding response as JSON: %s", err)
+		http.Error(w, message, http.StatusInternalServerError)
+		return
+	}
+}
+
+// setUserPool sets the pool new configs of the user get their addresses from.
+func (h UserHandler) setUserPool(w http.ResponseWriter, username UserID, pool string) {
+	if _, exists := h.Server.addressPools[pool]; !exists {
+		replyWithError(w, UnknownPool, fmt.Sprintf("Pool '%s' does not exist.", pool))
+		return
+	}
+
+	if err := h.Server.Storage.SetUserPool(username, pool); err != nil {
+		message := fmt.Sprintf("Error setting pool: %s", err)
+		http.Error(w, message, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// setConfigLimit sets the maximum amount of configs of a user. The limit "default" removes the limit of the user so
+// the default of the server is used. Existing configs are not deleted when the user has more configs than the limit.
+func (h UserHandler) setConfigLimit(w http.ResponseWriter, username UserID, limit string) {
+	var maxConfigs *int
+	if limit != "default" {
+		value, err := strconv.Atoi(limit)
+		if err != nil || value < 0 {
+			message := fmt.Sprintf("Invalid limit: '%s'. Must be a non-negative number or 'default'.", limit)
+			replyWithError(w, InvalidConfigLimit, message)
+			return
+		}
+		maxConfigs = &value
+	}
+
+	if err := h.Server.Storage.SetMaxConfigs(username, maxConfigs); err != nil {
+		message := fmt.Sprintf("Error setting config limit: %s", err)
+		http.Error(w, message, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// getQuotaStatus replies with the monthly quota of a user and the traffic of the user in the current month.
+func (h UserHandler) getQuotaStatus(w http.ResponseWriter, username UserID) {
+	if !h.checkUsageAvailable(w) {
+		return
+	}
+	if err := json.NewEncoder(w).Encode(h.Server.getQuotaStatus(username, time.Now())); err != nil {
+		message := fmt.Sprintf("Error encoding response as JSON: %s", err)
+		http.Error(w, message, http.StatusInternalServerError)
+		return
+	}
+}
+
+// setMonthlyQuota sets the monthly traffic quota of a user in bytes. The quota "default" removes the quota of the user
+// so the default of the server is used. The user is disabled or enabled immediately if the new quota requires it.
+func (h UserHandler) setMonthlyQuota(w http.ResponseWriter, username UserID, quota string) {
+	if !h.checkUsageAvailable(w) {
+		return
+	}
+	var monthlyQuota *int64
+	if quota != "default" {
+		value, err := strconv.ParseInt(quota, 10, 64)
+		if err != nil || value < 0 {
+			message := fmt.Sprintf("Invalid quota: '%s'. Must be a non-negative number of bytes or 'default'.", quota)
+			replyWithError(w, InvalidQuota, message)
+			return
+		}
+		monthlyQuota = &value
+	}
+
+	if err := h.Server.Storage.SetMonthlyQuota(username, monthlyQuota); err != nil {
+		message := fmt.Sprintf("Error setting quota: %s", err)
+		http.Error(w, message, http.StatusInternalServerError)
+		return
+	}
+	if err := h.Server.enforceQuota(username, time.Now()); err != nil {
+		message := fmt.Sprintf("Error enforcing quota: %s", err)
+		http.Error(w, message, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// getSessions replies with the sessions of a user between from and to.
+func (h UserHandler) getSessions(w http.ResponseWriter, username UserID, publicKey *PublicKey, from time.Time,
+	to time.Time) {
+
+	if h.Server.sessions == nil {
+		replyWithError(w, SessionsUnavailable, "Recording sessions is disabled.")
+		return
+	}
+	sessions, err := h.Server.sessions.GetSessions(username, publicKey, from, to)
+	if err != nil {
+		message := fmt.Sprintf("Error reading sessions: %s", err)
+		http.Error(w, message, http.StatusInternalServerError)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(sessions); err != nil {
+		message := fmt.Sprintf("Error encoding response as JSON: %s", err)
+		http.Error(w, message, http.StatusInternalServerError)
+		return
+	}
+}
+
+// getMetrics replies with metrics in the Prometheus text format.
+func (h UserHandler) getMetrics(w http.ResponseWriter) {
+	var b strings.Builder
+	h.Server.writeMetrics(&b)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if _, err := w.Write([]byte(b.String())); err != nil {
+		log.Print("Error writing metrics: ", err)
+	}
 }
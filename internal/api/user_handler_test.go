@@ -8,7 +8,9 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
@@ -21,6 +23,8 @@ type TestWGManager struct {
 	configureWG            error
 	getConnectionsPeerList []wgtypes.Peer
 	getConnectionsError    error
+	getPeersPeerList       []wgtypes.Peer
+	interfaceAddresses     []net.IPNet
 }
 
 func (wgm TestWGManager) GetPublicKey() (PrivateKey, error) {
@@ -32,6 +36,11 @@ func (wgm TestWGManager) GeneratePrivateKey() (PrivateKey, error) {
 	return PrivateKey{privateKey}, err
 }
 
+func (wgm TestWGManager) GeneratePresharedKey() (PresharedKey, error) {
+	presharedKey, err := wgtypes.GenerateKey()
+	return PresharedKey{presharedKey}, err
+}
+
 func (wgm TestWGManager) ConfigureWG(peers []wgmanager.Peer) error {
 	return wgm.configureWG
 }
@@ -48,13 +57,21 @@ func (wgm TestWGManager) GetConnections() ([]wgtypes.Peer, error) {
 	return wgm.getConnectionsPeerList, wgm.getConnectionsError
 }
 
+func (wgm TestWGManager) GetPeers() ([]wgtypes.Peer, error) {
+	return wgm.getPeersPeerList, nil
+}
+
+func (wgm TestWGManager) GetInterfaceAddresses() ([]net.IPNet, error) {
+	return wgm.interfaceAddresses, nil
+}
+
 const petersPublicKey1String = "1+Peters/+/Rand0m//Public+Key/For+H1s/Phonc="
 const petersPublicKey2String = "2+Peters/+/Rand0m//Public+Key/For+H1s/Phonc="
 const petersPublicKey3String = "3+Peters/+/Rand0m//Public+Key/For+H1s/Phonc="
 
 //todo: test public api but not in memory data
 func newServer(server *Server) {
-	var ipAddr, ipNet, _ = net.ParseCIDR("10.0.0.1/8")
+	addressPool, _ := ParseAddressPool("10.0.0.1/8", "fd00::1/64")
 
 	wgManager := TestWGManager{}
 
@@ -66,26 +83,27 @@ func newServer(server *Server) {
 	petersPublicKey3, _ := wgtypes.ParseKey(petersPublicKey3String)
 
 	*server = Server{
-		IPAddr:        ipAddr,
-		clientIPRange: ipNet,
-		wgManager:     wgManager,
-		wgPublicKey:   publicKey,
+		wgManager:   wgManager,
+		wgPublicKey: publicKey,
 		Storage: &FileStorage{
-			filePath: "/dev/null",
+			filePath: filepath.Join(testStorageDir, "storage.json"),
 			data: data{
 				Users: map[UserID]*User{
 					peterUsername: &User{
 						Clients: map[PublicKey]ClientConfig{
 							PublicKey{petersPublicKey1}: ClientConfig{
 								IP:       net.IPv4(10, 0, 0, 1),
+								IPv6:     net.ParseIP("fd00::1"),
 								Modified: TimeJ{time.Date(2020, 10, 13, 17, 52, 14, 4, time.UTC)},
 							},
 							PublicKey{petersPublicKey2}: ClientConfig{
 								IP:       net.IPv4(10, 0, 0, 2),
+								IPv6:     net.ParseIP("fd00::2"),
 								Modified: TimeJ{time.Date(2020, 10, 13, 17, 53, 14, 4, time.UTC)},
 							},
 							PublicKey{petersPublicKey3}: ClientConfig{
 								IP:       net.IPv4(10, 0, 0, 3),
+								IPv6:     net.ParseIP("fd00::3"),
 								Modified: TimeJ{time.Date(2020, 10, 13, 17, 54, 14, 4, time.UTC)},
 							},
 						},
@@ -94,6 +112,7 @@ func newServer(server *Server) {
 			},
 		},
 	}
+	server.setAddressPools(map[string]AddressPool{DefaultPool: addressPool})
 }
 
 var server *Server = &Server{}
@@ -107,6 +126,7 @@ func setup() {
 }
 
 var expIPString = "10.0.0.4"
+var expIPv6String = "fd00::4"
 
 const peterUsername = "Peter @ /K.org"
 
@@ -137,6 +157,7 @@ func testError(t *testing.T, w httptest.ResponseRecorder, apiError *Error) {
 
 type ClientConfigStrings struct {
 	IP       string `json:"ip"`
+	IPv6     string `json:"ipv6"`
 	Modified string `json:"modified"`
 }
 
@@ -158,14 +179,17 @@ func TestGetConfigs(t *testing.T) {
 	exp := map[string]*ClientConfigStrings{
 		petersPublicKey1String: {
 			IP:       "10.0.0.1",
+			IPv6:     "fd00::1",
 			Modified: "2020-10-13T17:52:14Z",
 		},
 		petersPublicKey2String: {
 			IP:       "10.0.0.2",
+			IPv6:     "fd00::2",
 			Modified: "2020-10-13T17:53:14Z",
 		},
 		petersPublicKey3String: {
 			IP:       "10.0.0.3",
+			IPv6:     "fd00::3",
 			Modified: "2020-10-13T17:54:14Z",
 		},
 	}
@@ -244,6 +268,7 @@ func testCreateConfig(t *testing.T, username string, publicKeyString string, api
 
 	type response struct {
 		IP              string
+		IPv6            string
 		ServerPublicKey string
 	}
 
@@ -257,6 +282,7 @@ func testCreateConfig(t *testing.T, username string, publicKeyString string, api
 
 		exp := response{
 			IP:              expIPString,
+			IPv6:            expIPv6String,
 			ServerPublicKey: server.GetPublicKey().String(),
 		}
 
@@ -267,10 +293,12 @@ func testCreateConfig(t *testing.T, username string, publicKeyString string, api
 
 	{
 		publicKey, _ := wgtypes.ParseKey(publicKeyString)
-		got := server.Storage.data.Users[UserID(username)].Clients[PublicKey{publicKey}]
+		got := server.Storage.GetUserClients(UserID(username))[PublicKey{publicKey}]
 
 		exp := ClientConfig{
 			IP:       net.ParseIP(expIPString),
+			IPv6:     net.ParseIP(expIPv6String),
+			Pool:     DefaultPool,
 			Modified: got.Modified, //todo: test
 		}
 
@@ -318,6 +346,7 @@ func testCreateConfigGenerateKeyPair(t *testing.T, username string) wgtypes.Key
 		ClientPrivateKey string
 		ClientPublicKey  string
 		IP               string
+		IPv6             string
 		ServerPublicKey  string
 	}
 
@@ -335,6 +364,7 @@ func testCreateConfigGenerateKeyPair(t *testing.T, username string) wgtypes.Key
 			ClientPrivateKey: got.ClientPrivateKey, //todo: test
 			ClientPublicKey:  got.ClientPublicKey,  //todo: test
 			IP:               expIPString,
+			IPv6:             expIPv6String,
 			ServerPublicKey:  server.GetPublicKey().String(),
 		}
 
@@ -355,10 +385,12 @@ func testCreateConfigGenerateKeyPair(t *testing.T, username string) wgtypes.Key
 
 		publicKey = key.PublicKey()
 
-		got := server.Storage.data.Users[UserID(username)].Clients[PublicKey{publicKey}]
+		got := server.Storage.GetUserClients(UserID(username))[PublicKey{publicKey}]
 
 		exp := ClientConfig{
 			IP:       net.ParseIP(expIPString),
+			IPv6:     net.ParseIP(expIPv6String),
+			Pool:     DefaultPool,
 			Modified: got.Modified, //todo: test
 		}
 
@@ -388,7 +420,7 @@ func testDeleteConfig(t *testing.T, username string, publicKeyString string) {
 	testHTTPStatus(t, *respRec, http.StatusOK)
 
 	publicKey, _ := wgtypes.ParseKey(publicKeyString)
-	_, exists := server.Storage.data.Users[UserID(username)].Clients[PublicKey{publicKey}]
+	_, exists := server.Storage.GetUserClients(UserID(username))[PublicKey{publicKey}]
 	if exists {
 		t.Error("Config exists")
 	}
@@ -413,7 +445,7 @@ func testDisableUser(t *testing.T, username string, apiError *Error) {
 
 	testError(t, *respRec, apiError)
 
-	disabled := server.Storage.data.Users[UserID(username)].IsDisabled
+	disabled := server.Storage.IsDisabled(UserID(username))
 	if !disabled {
 		t.Error("User not disabled.")
 	}
@@ -431,7 +463,7 @@ func testEnableUser(t *testing.T, username string, apiError *Error) {
 
 	testError(t, *respRec, apiError)
 
-	disabled := server.Storage.data.Users[UserID(username)].IsDisabled
+	disabled := server.Storage.IsDisabled(UserID(username))
 	if disabled {
 		t.Error("User disabled.")
 	}
@@ -474,23 +506,532 @@ func TestWireGuardReconfigureError(t *testing.T) {
 	testEnableUser(t, peterUsername, &Error{"internal_server_error"})
 }
 
+func TestCreateConfigWireGuardError(t *testing.T) {
+	setup()
+	server.wgManager = TestWGManager{
+		configureWG: errors.New("oops"),
+	}
+	petersConfigs := server.Storage.GetUserClients(peterUsername)
+
+	// Neither a new nor an overwritten config is saved.
+	testCreateConfig(t, "Emma", "RuvRcz3zuwz/3xMqqh2ZvL+NT3W2v6J60rMnHtRiOE8=", &Error{"internal_server_error"})
+	testCreateConfig(t, peterUsername, petersPublicKey1String, &Error{"internal_server_error"})
+	if got := server.Storage.GetUserClients("Emma"); len(got) != 0 {
+		t.Errorf("Config was saved: %v", got)
+	}
+	if got := server.Storage.GetUserClients(peterUsername); !cmp.Equal(got, petersConfigs) {
+		t.Error("Diff: ", cmp.Diff(petersConfigs, got))
+	}
+
+	// The addresses are released.
+	server.wgManager = TestWGManager{}
+	testCreateConfig(t, "Emma", "RuvRcz3zuwz/3xMqqh2ZvL+NT3W2v6J60rMnHtRiOE8=", nil)
+}
+
 func TestNoIPAvailableError(t *testing.T) {
 	setup()
-	var ipAddr, ipNet, _ = net.ParseCIDR("10.0.0.1/29")
-	server.IPAddr = ipAddr
-	server.clientIPRange = ipNet
+	addressPool, _ := ParseAddressPool("10.0.0.1/29", "fd00::1/64")
+	server.setAddressPools(map[string]AddressPool{DefaultPool: addressPool})
 
 	testCreateConfig(t, "Alex", "gldbEWimMuf1qloClRRPEmlMYtJn2dfZg8g2Yjh3bTQ=", nil)
 	expIPString = "10.0.0.5"
+	expIPv6String = "fd00::5"
 	testCreateConfig(t, "Alex", "DZPvQpSrkz9OZiBNIoVA8Pj0VcUBfkzYhLLXmbJSFAk=", nil)
 	expIPString = "10.0.0.6"
+	expIPv6String = "fd00::6"
 	testCreateConfigGenerateKeyPair(t, "Alex")
-	expIPString = "10.0.0.7"
-	testCreateConfig(t, "Edward", "FSOJ4iX90JLnTix9Se98NXsUOuD9sIQ5aExE9vDk7Xk=", nil)
-	expIPString = "10.0.0.8"
-	testCreateConfig(t, "Nick", "FSOJ4iX90JLnTix9Se98NXsUOuD9sIQ5aExE9vDk7Xk=", nil)
-	expIPString = "10.0.0.9"
 
+	// 10.0.0.7 is the broadcast address of 10.0.0.0/29.
+	testCreateConfig(t, "Edward", "FSOJ4iX90JLnTix9Se98NXsUOuD9sIQ5aExE9vDk7Xk=", &NoIPAvailable)
 	testCreateConfig(t, "Nick", "ay5VxKyMf3vD2fe1szrbWGO3m2VcZ0Qqnul8PE95D1s=", &NoIPAvailable)
 	testCreateConfigGenerateKeyPairError(t, "Nick", &NoIPAvailable)
 }
+
+func testCreateConfigInPool(t *testing.T, username string, pool string, apiError *Error) net.IP {
+	requestBody := url.Values{
+		"user_id": {username},
+		"pool":    {pool},
+	}
+	body := bytes.NewBufferString(requestBody.Encode())
+	req, _ := http.NewRequest(http.MethodPost, "/create_config_and_key_pair", body)
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+
+	respRec := httptest.NewRecorder()
+	apiRouter.ServeHTTP(respRec, req)
+
+	testError(t, *respRec, apiError)
+	if apiError != nil {
+		return nil
+	}
+
+	got := struct {
+		IP string
+	}{}
+	if err := json.NewDecoder(respRec.Body).Decode(&got); err != nil {
+		t.Errorf("Error decoding JSON: %s", err)
+	}
+	return net.ParseIP(got.IP)
+}
+
+func testSetUserPool(t *testing.T, username string, pool string, apiError *Error) {
+	requestBody := url.Values{
+		"user_id": {username},
+		"pool":    {pool},
+	}
+	req, _ := http.NewRequest(http.MethodPost, "/set_user_pool", bytes.NewBufferString(requestBody.Encode()))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+
+	respRec := httptest.NewRecorder()
+	apiRouter.ServeHTTP(respRec, req)
+
+	testError(t, *respRec, apiError)
+}
+
+func TestPools(t *testing.T) {
+	setup()
+	guestsPool, _ := ParseAddressPool("10.1.0.1/29", "fd01::1/64")
+	server.setAddressPools(map[string]AddressPool{DefaultPool: server.addressPools[DefaultPool], "guests": guestsPool})
+	_, guestsRange, _ := net.ParseCIDR("10.1.0.0/29")
+
+	if ip := testCreateConfigInPool(t, "Emma", "guests", nil); !guestsRange.Contains(ip) {
+		t.Errorf("IP %s is not in the guests pool", ip)
+	}
+	testCreateConfigInPool(t, "Emma", "students", &UnknownPool)
+	testSetUserPool(t, "Emma", "students", &UnknownPool)
+
+	testSetUserPool(t, "Emma", "guests", nil)
+	if ip := testCreateConfigInPool(t, "Emma", "", nil); !guestsRange.Contains(ip) {
+		t.Errorf("IP %s is not in the pool of the user", ip)
+	}
+	for i := 0; i < 3; i++ {
+		testCreateConfigInPool(t, "Eric", "guests", nil)
+	}
+
+	// The guests pool is exhausted, the default pool is not.
+	testCreateConfigInPool(t, "Emma", "", &NoIPAvailable)
+	testCreateConfigInPool(t, "Eric", "guests", &NoIPAvailable)
+	if ip := testCreateConfigInPool(t, "Emma", DefaultPool, nil); guestsRange.Contains(ip) {
+		t.Errorf("IP %s is not in the default pool", ip)
+	}
+}
+
+func testEnableUserConfigs(t *testing.T, username string, apiError *Error) map[string]*ClientConfigStrings {
+	parameters := url.Values{
+		"user_id": {username},
+	}
+	req, _ := http.NewRequest(http.MethodPost, "/enable_user?"+parameters.Encode(), nil)
+	respRec := httptest.NewRecorder()
+	apiRouter.ServeHTTP(respRec, req)
+	testError(t, *respRec, apiError)
+	if apiError != nil {
+		return nil
+	}
+
+	got := map[string]*ClientConfigStrings{}
+	if err := json.NewDecoder(respRec.Body).Decode(&got); err != nil {
+		t.Errorf("Error decoding json: %s", err)
+	}
+	return got
+}
+
+func TestReleaseIPsOfDisabledUser(t *testing.T) {
+	setup()
+	server.disabledUserIPPolicy = ReleaseIPs
+	petersPublicKey2, _ := wgtypes.ParseKey(petersPublicKey2String)
+
+	testDisableUser(t, peterUsername, nil)
+	for publicKey, config := range server.Storage.GetUserClients(peterUsername) {
+		if config.IP != nil || config.IPv6 != nil {
+			t.Errorf("Addresses of config %s were not released: %s, %s", publicKey, config.IP, config.IPv6)
+		}
+	}
+
+	// The released addresses can be used by other users.
+	emmasIP := testCreateConfigInPool(t, "Emma", "", nil)
+	if !emmasIP.Equal(net.IPv4(10, 0, 0, 2)) && !emmasIP.Equal(net.IPv4(10, 0, 0, 3)) {
+		t.Errorf("Released address was not reused, got: %s", emmasIP)
+	}
+
+	got := testEnableUserConfigs(t, peterUsername, nil)
+	if len(got) != 3 {
+		t.Errorf("Expected 3 configs, got: %v", got)
+	}
+	ips := map[string]bool{emmasIP.String(): true}
+	for publicKey, config := range got {
+		if config.IP == "" || config.IPv6 == "" || ips[config.IP] || ips[config.IPv6] {
+			t.Errorf("Config %s did not get new unique addresses: %s, %s", publicKey, config.IP, config.IPv6)
+		}
+		ips[config.IP] = true
+		ips[config.IPv6] = true
+	}
+	stored := server.Storage.GetUserClients(peterUsername)[PublicKey{petersPublicKey2}]
+	if stored.IP.String() != got[petersPublicKey2String].IP {
+		t.Errorf("Got: %s, Wanted: %s", stored.IP, got[petersPublicKey2String].IP)
+	}
+}
+
+func TestReleaseIPsOfDisabledUserNoIPAvailable(t *testing.T) {
+	setup()
+	server.disabledUserIPPolicy = ReleaseIPs
+	addressPool, _ := ParseAddressPool("10.0.0.1/29", "fd00::1/64")
+	server.setAddressPools(map[string]AddressPool{DefaultPool: addressPool})
+
+	testDisableUser(t, peterUsername, nil)
+	for i := 0; i < 5; i++ {
+		testCreateConfigInPool(t, "Emma", "", nil)
+	}
+
+	testEnableUserConfigs(t, peterUsername, &NoIPAvailable)
+	if !server.Storage.IsDisabled(peterUsername) {
+		t.Error("User enabled without addresses.")
+	}
+}
+
+func TestReleaseIPsOfDisabledUserUnknownPool(t *testing.T) {
+	setup()
+	server.disabledUserIPPolicy = ReleaseIPs
+	addressPool, _ := ParseAddressPool("10.0.0.1/8", "fd00::1/64")
+	server.setAddressPools(map[string]AddressPool{DefaultPool: addressPool, "students": addressPool})
+
+	testCreateConfigInPool(t, "Emma", "students", nil)
+	testDisableUser(t, "Emma", nil)
+	server.setAddressPools(map[string]AddressPool{DefaultPool: addressPool})
+
+	testEnableUserConfigs(t, "Emma", &UnknownPool)
+	if !server.Storage.IsDisabled("Emma") {
+		t.Error("User enabled without addresses.")
+	}
+}
+
+func testSetConfigLimit(t *testing.T, username string, limit string, apiError *Error) {
+	requestBody := url.Values{
+		"user_id": {username},
+		"limit":   {limit},
+	}
+	req, _ := http.NewRequest(http.MethodPost, "/set_config_limit", bytes.NewBufferString(requestBody.Encode()))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+
+	respRec := httptest.NewRecorder()
+	apiRouter.ServeHTTP(respRec, req)
+
+	testError(t, *respRec, apiError)
+}
+
+func TestConfigLimit(t *testing.T) {
+	setup()
+	server.maxConfigsPerUser = 2
+
+	testCreateConfigInPool(t, "Emma", "", nil)
+	testCreateConfigInPool(t, "Emma", "", nil)
+	testCreateConfigInPool(t, "Emma", "", &ConfigLimitReached)
+
+	// Peter already has more configs than the default limit.
+	testCreateConfigInPool(t, peterUsername, "", &ConfigLimitReached)
+	// Overwriting an existing config is allowed.
+	expIPString = "10.0.0.6"
+	expIPv6String = "fd00::6"
+	testCreateConfig(t, peterUsername, petersPublicKey1String, nil)
+
+	testSetConfigLimit(t, peterUsername, "4", nil)
+	testCreateConfigInPool(t, peterUsername, "", nil)
+	testCreateConfigInPool(t, peterUsername, "", &ConfigLimitReached)
+
+	testSetConfigLimit(t, "Emma", "0", nil)
+	testCreateConfigInPool(t, "Emma", "", nil)
+
+	testSetConfigLimit(t, "Emma", "default", nil)
+	testCreateConfigInPool(t, "Emma", "", &ConfigLimitReached)
+
+	testSetConfigLimit(t, "Emma", "-1", &InvalidConfigLimit)
+	testSetConfigLimit(t, "Emma", "many", &InvalidConfigLimit)
+}
+
+func testRotatePresharedKey(t *testing.T, username string, publicKey string, apiError *Error) string {
+	requestBody := url.Values{
+		"user_id":    {username},
+		"public_key": {publicKey},
+	}
+	req, _ := http.NewRequest(http.MethodPost, "/rotate_preshared_key", bytes.NewBufferString(requestBody.Encode()))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+
+	respRec := httptest.NewRecorder()
+	apiRouter.ServeHTTP(respRec, req)
+
+	testError(t, *respRec, apiError)
+	if apiError != nil {
+		return ""
+	}
+	got := struct{ PresharedKey string }{}
+	if err := json.NewDecoder(respRec.Body).Decode(&got); err != nil {
+		t.Errorf("Error decoding JSON: %s", err)
+	}
+	return got.PresharedKey
+}
+
+func TestPresharedKey(t *testing.T) {
+	setup()
+	requestBody := url.Values{
+		"user_id":       {peterUsername},
+		"preshared_key": {"true"},
+	}
+	req, _ := http.NewRequest(http.MethodPost, "/create_config_and_key_pair",
+		bytes.NewBufferString(requestBody.Encode()))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	respRec := httptest.NewRecorder()
+	apiRouter.ServeHTTP(respRec, req)
+	testError(t, *respRec, nil)
+
+	response := createConfigAndKeyPairResponse{}
+	if err := json.NewDecoder(respRec.Body).Decode(&response); err != nil {
+		t.Fatalf("Error decoding JSON: %s", err)
+	}
+	if response.PresharedKey == nil {
+		t.Fatal("No preshared key returned.")
+	}
+	publicKey := response.ClientPublicKey
+	stored := server.Storage.GetUserClients(peterUsername)[publicKey]
+	if stored.PresharedKey == nil || *stored.PresharedKey != *response.PresharedKey {
+		t.Errorf("Got stored preshared key: %v, Wanted: %s", stored.PresharedKey, response.PresharedKey)
+	}
+
+	parameters := url.Values{"user_id": {peterUsername}}
+	req, _ = http.NewRequest(http.MethodGet, "/configs?"+parameters.Encode(), nil)
+	respRec = httptest.NewRecorder()
+	apiRouter.ServeHTTP(respRec, req)
+	if bytes.Contains(respRec.Body.Bytes(), []byte("presharedKey")) {
+		t.Errorf("Preshared key returned when listing configs: %s", respRec.Body)
+	}
+
+	rotated := testRotatePresharedKey(t, peterUsername, publicKey.String(), nil)
+	stored = server.Storage.GetUserClients(peterUsername)[publicKey]
+	if rotated == response.PresharedKey.String() || stored.PresharedKey.String() != rotated {
+		t.Errorf("Preshared key was not rotated, old: %s, new: %s, stored: %s",
+			response.PresharedKey, rotated, stored.PresharedKey)
+	}
+	if !stored.IP.Equal(response.IP) || !stored.IPv6.Equal(response.IPv6) {
+		t.Errorf("Addresses changed when rotating preshared key.")
+	}
+
+	testRotatePresharedKey(t, "Nick", publicKey.String(), &ConfigNotFound)
+}
+
+func testCreateConfigWithRouting(t *testing.T, username string, allowedIPs string, persistentKeepalive string,
+	apiError *Error) PublicKey {
+
+	privateKey, _ := TestWGManager{}.GeneratePrivateKey()
+	requestBody := url.Values{
+		"user_id":              {username},
+		"public_key":           {privateKey.PublicKey().String()},
+		"allowed_ips":          {allowedIPs},
+		"persistent_keepalive": {persistentKeepalive},
+	}
+	req, _ := http.NewRequest(http.MethodPost, "/create_config", bytes.NewBufferString(requestBody.Encode()))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+
+	respRec := httptest.NewRecorder()
+	apiRouter.ServeHTTP(respRec, req)
+
+	testError(t, *respRec, apiError)
+	return privateKey.PublicKey()
+}
+
+func testSetConfigRouting(t *testing.T, username string, publicKey PublicKey, allowedIPs string,
+	persistentKeepalive string, apiError *Error) {
+
+	requestBody := url.Values{
+		"user_id":              {username},
+		"public_key":           {publicKey.String()},
+		"allowed_ips":          {allowedIPs},
+		"persistent_keepalive": {persistentKeepalive},
+	}
+	req, _ := http.NewRequest(http.MethodPost, "/set_config_routing", bytes.NewBufferString(requestBody.Encode()))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+
+	respRec := httptest.NewRecorder()
+	apiRouter.ServeHTTP(respRec, req)
+
+	testError(t, *respRec, apiError)
+}
+
+func TestConfigRouting(t *testing.T) {
+	setup()
+	router := testCreateConfigWithRouting(t, "Emma", "192.168.10.0/24, fd10::/64", "25", nil)
+	config := server.Storage.GetUserClients("Emma")[router]
+	peer := ClientToWGPeer(router, config)
+	var got []string
+	for _, allowedIP := range peer.AllowedIPs {
+		got = append(got, allowedIP.String())
+	}
+	exp := []string{config.IP.String() + "/32", config.IPv6.String() + "/128", "192.168.10.0/24", "fd10::/64"}
+	if !cmp.Equal(got, exp) {
+		t.Errorf("Got: %v, Wanted: %v", got, exp)
+	}
+	if peer.PersistentKeepalive != 25*time.Second {
+		t.Errorf("Got keepalive: %s, Wanted: 25s", peer.PersistentKeepalive)
+	}
+
+	testCreateConfigWithRouting(t, "Emma", "192.168.10.128/25", "", &AllowedIPsOverlap)
+	testCreateConfigWithRouting(t, "Emma", "10.1.0.0/16", "", &AllowedIPsOverlap)
+	testCreateConfigWithRouting(t, "Emma", "fd00::/48", "", &AllowedIPsOverlap)
+	testCreateConfigWithRouting(t, "Emma", "192.168.20.0/24,192.168.20.0/25", "", &AllowedIPsOverlap)
+	testCreateConfigWithRouting(t, "Emma", "192.168.20.0", "", &InvalidAllowedIPs)
+	testCreateConfigWithRouting(t, "Emma", "", "65536", &InvalidKeepalive)
+	testCreateConfigWithRouting(t, "Emma", "", "-1", &InvalidKeepalive)
+
+	// The networks of a config may overlap with the previous networks of the same config.
+	testSetConfigRouting(t, "Emma", router, "192.168.10.0/23", "", nil)
+	config = server.Storage.GetUserClients("Emma")[router]
+	if len(config.AllowedIPs) != 1 || config.AllowedIPs[0].String() != "192.168.10.0/23" ||
+		config.PersistentKeepalive != 0 {
+		t.Errorf("Routing not updated: %v, %d", config.AllowedIPs, config.PersistentKeepalive)
+	}
+	testSetConfigRouting(t, "Nick", router, "", "", &ConfigNotFound)
+
+	testCreateConfigWithRouting(t, "Emma", "192.168.20.0/24", "", nil)
+}
+
+func testCreateConfigWithExpiry(t *testing.T, username string, expires string, apiError *Error) PublicKey {
+	privateKey, _ := TestWGManager{}.GeneratePrivateKey()
+	requestBody := url.Values{
+		"user_id":    {username},
+		"public_key": {privateKey.PublicKey().String()},
+		"expires":    {expires},
+	}
+	req, _ := http.NewRequest(http.MethodPost, "/create_config", bytes.NewBufferString(requestBody.Encode()))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+
+	respRec := httptest.NewRecorder()
+	apiRouter.ServeHTTP(respRec, req)
+
+	testError(t, *respRec, apiError)
+	return privateKey.PublicKey()
+}
+
+func TestConfigExpiry(t *testing.T) {
+	setup()
+	server.expiredConfigPolicy = DeleteExpiredConfigs
+	expires := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+
+	testCreateConfigWithExpiry(t, "Emma", "tomorrow", &InvalidExpiry)
+	testCreateConfigWithExpiry(t, "Emma", time.Now().Add(-time.Hour).Format(time.RFC3339), &InvalidExpiry)
+	guest := testCreateConfigWithExpiry(t, "Emma", expires.Format(time.RFC3339), nil)
+
+	parameters := url.Values{"user_id": {"Emma"}}
+	req, _ := http.NewRequest(http.MethodGet, "/configs?"+parameters.Encode(), nil)
+	respRec := httptest.NewRecorder()
+	apiRouter.ServeHTTP(respRec, req)
+	got := map[string]struct{ Expires string }{}
+	if err := json.NewDecoder(respRec.Body).Decode(&got); err != nil {
+		t.Errorf("Error decoding json: %s", err)
+	}
+	if got[guest.String()].Expires != expires.Format(time.RFC3339) {
+		t.Errorf("Got expiry: %s, Wanted: %s", got[guest.String()].Expires, expires.Format(time.RFC3339))
+	}
+
+	if err := server.removeExpiredConfigs(expires.Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	config, exists := server.Storage.GetUserClients("Emma")[guest]
+	if !exists {
+		t.Fatal("Config deleted before it expired.")
+	}
+
+	if err := server.removeExpiredConfigs(expires); err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := server.Storage.GetUserClients("Emma")[guest]; exists {
+		t.Error("Expired config not deleted.")
+	}
+	ip, _, _ := server.allocateIPs(DefaultPool)
+	if !ip.Equal(config.IP) {
+		t.Errorf("Address of expired config not released, got: %s, wanted: %s", ip, config.IP)
+	}
+}
+
+func TestMarkExpiredConfigs(t *testing.T) {
+	setup()
+	server.expiredConfigPolicy = MarkExpiredConfigs
+	expires := time.Now().Add(time.Hour)
+	guest := testCreateConfigWithExpiry(t, "Emma", expires.Format(time.RFC3339), nil)
+
+	if err := server.removeExpiredConfigs(expires.Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	config, exists := server.Storage.GetUserClients("Emma")[guest]
+	if !exists || !config.Expired {
+		t.Errorf("Expired config not marked as expired: %v", config)
+	}
+	if server.isPeerActive("Emma", config) {
+		t.Error("Expired config is active.")
+	}
+}
+
+func testRenameConfig(t *testing.T, username string, publicKey PublicKey, name string, apiError *Error) {
+	requestBody := url.Values{
+		"user_id":    {username},
+		"public_key": {publicKey.String()},
+		"name":       {name},
+	}
+	req, _ := http.NewRequest(http.MethodPost, "/rename_config", bytes.NewBufferString(requestBody.Encode()))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+
+	respRec := httptest.NewRecorder()
+	apiRouter.ServeHTTP(respRec, req)
+
+	testError(t, *respRec, apiError)
+}
+
+func TestConfigNameAndMetadata(t *testing.T) {
+	setup()
+	newRequest := func(requestBody url.Values) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(http.MethodPost, "/create_config_and_key_pair",
+			bytes.NewBufferString(requestBody.Encode()))
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		respRec := httptest.NewRecorder()
+		apiRouter.ServeHTTP(respRec, req)
+		return respRec
+	}
+
+	respRec := newRequest(url.Values{
+		"user_id":              {"Emma"},
+		"name":                 {"Laptop"},
+		"metadata[device]":     {"laptop"},
+		"metadata[created_by]": {"portal"},
+	})
+	testError(t, *respRec, nil)
+	response := createConfigAndKeyPairResponse{}
+	if err := json.NewDecoder(respRec.Body).Decode(&response); err != nil {
+		t.Fatalf("Error decoding JSON: %s", err)
+	}
+	publicKey := response.ClientPublicKey
+
+	respRec = newRequest(url.Values{"user_id": {"Emma"}, "name": {strings.Repeat("a", 65)}})
+	testError(t, *respRec, &InvalidName)
+	respRec = newRequest(url.Values{"user_id": {"Emma"}, "metadata[]": {"empty key"}})
+	testError(t, *respRec, &InvalidMetadata)
+
+	testRenameConfig(t, "Emma", publicKey, "Work laptop", nil)
+	testRenameConfig(t, "Nick", publicKey, "Work laptop", &ConfigNotFound)
+
+	parameters := url.Values{"user_id": {"Emma"}}
+	req, _ := http.NewRequest(http.MethodGet, "/configs?"+parameters.Encode(), nil)
+	respRec = httptest.NewRecorder()
+	apiRouter.ServeHTTP(respRec, req)
+	type configResponse struct {
+		Name     string
+		Metadata map[string]string
+	}
+	got := map[string]configResponse{}
+	if err := json.NewDecoder(respRec.Body).Decode(&got); err != nil {
+		t.Errorf("Error decoding json: %s", err)
+	}
+	exp := map[string]configResponse{
+		publicKey.String(): {
+			Name:     "Work laptop",
+			Metadata: map[string]string{"device": "laptop", "created_by": "portal"},
+		},
+	}
+	if !cmp.Equal(got, exp) {
+		t.Error("Diff: ", cmp.Diff(exp, got))
+	}
+}
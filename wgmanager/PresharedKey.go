@@ -0,0 +1,29 @@
+package wgmanager
+
+import (
+	"fmt"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// PresharedKey is a symmetric key shared by the server and a peer, it is not a private key and has no public key.
+type PresharedKey struct {
+	wgtypes.Key
+}
+
+func (k *PresharedKey) UnmarshalText(data []byte) error {
+	key, err := wgtypes.ParseKey(string(data))
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal key to json: %v", err)
+	}
+	*k = PresharedKey{key}
+	return nil
+}
+
+func (k PresharedKey) MarshalText() ([]byte, error) {
+	return []byte(k.String()), nil
+}
+
+func (k PresharedKey) String() string {
+	return k.Key.String()
+}
@@ -2,6 +2,7 @@ package wgmanager
 
 import (
 	"net"
+	"time"
 
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
@@ -9,13 +10,20 @@ import (
 type Peer struct {
 	PublicKey  PublicKey
 	AllowedIPs []net.IPNet
+	// PresharedKey of the peer, nil if the peer does not use a preshared key.
+	PresharedKey *PresharedKey
+	// Interval in which keepalive packets are sent to the peer, 0 disables keepalive packets.
+	PersistentKeepalive time.Duration
 }
 
 type IWGManager interface {
 	GetPublicKey() (PublicKey, error)
 	GeneratePrivateKey() (PrivateKey, error)
+	GeneratePresharedKey() (PresharedKey, error)
 	ConfigureWG(peers []Peer) error
 	AddPeers(peers []Peer) error
 	RemovePeers(publicKeys []PublicKey) error
 	GetConnections() ([]wgtypes.Peer, error)
+	GetPeers() ([]wgtypes.Peer, error)
+	GetInterfaceAddresses() ([]net.IPNet, error)
 }
@@ -0,0 +1,134 @@
+package wgmanager
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// Multicast group of rtnetlink link events, RTMGRP_LINK in linux/rtnetlink.h.
+const rtmgrpLink = 0x1
+
+// LinkWatcher watches rtnetlink link events to report when a network interface is created, for example when
+// systemd-networkd recreates the WireGuard interface without peers.
+type LinkWatcher struct {
+	name string
+	file *os.File
+	// Index of the interface, 0 if the interface does not exist.
+	index int
+}
+
+// NewLinkWatcher starts watching link events of the interface with the given name. Interfaces created in the network
+// namespace the calling thread is in are watched.
+func NewLinkWatcher(name string) (*LinkWatcher, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return nil, fmt.Errorf("error creating netlink socket: %w", err)
+	}
+	address := &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK, Groups: rtmgrpLink}
+	if err := syscall.Bind(fd, address); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("error subscribing to link events: %w", err)
+	}
+	// A non-blocking file uses the runtime poller, so Close stops a pending Read.
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+
+	index := 0
+	// The interface is looked up after subscribing, so it can not be created unnoticed in between.
+	if wgInterface, err := net.InterfaceByName(name); err == nil {
+		index = wgInterface.Index
+	}
+	return &LinkWatcher{name: name, file: os.NewFile(uintptr(fd), "netlink"), index: index}, nil
+}
+
+// WaitCreated blocks until the interface is created. The interface being recreated, also under the same index, is
+// reported once. Changes of an existing interface, like setting it up, are not reported.
+func (w *LinkWatcher) WaitCreated() error {
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := w.file.Read(buf)
+		if errors.Is(err, syscall.ENOBUFS) {
+			// The receive buffer overflowed and events were dropped, so the interface is looked up again.
+			if w.resync() {
+				return nil
+			}
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("error reading link events: %w", err)
+		}
+		messages, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return fmt.Errorf("error parsing link events: %w", err)
+		}
+		for i := range messages {
+			if w.handleMessage(&messages[i]) {
+				return nil
+			}
+		}
+	}
+}
+
+// resync looks up the interface and returns true if it was created since the last known state. An interface which was
+// recreated under the same index while events were dropped is not noticed.
+func (w *LinkWatcher) resync() bool {
+	index := 0
+	if wgInterface, err := net.InterfaceByName(w.name); err == nil {
+		index = wgInterface.Index
+	}
+	created := index != 0 && index != w.index
+	w.index = index
+	return created
+}
+
+// handleMessage returns true if the message reports that the interface was created.
+func (w *LinkWatcher) handleMessage(message *syscall.NetlinkMessage) bool {
+	if message.Header.Type != syscall.RTM_NEWLINK && message.Header.Type != syscall.RTM_DELLINK {
+		return false
+	}
+	if len(message.Data) < syscall.SizeofIfInfomsg {
+		return false
+	}
+	ifInfo := (*syscall.IfInfomsg)(unsafe.Pointer(&message.Data[0]))
+	attributes, err := syscall.ParseNetlinkRouteAttr(message)
+	if err != nil {
+		return false
+	}
+	name := ""
+	for _, attribute := range attributes {
+		if attribute.Attr.Type == syscall.IFLA_IFNAME {
+			name = strings.TrimRight(string(attribute.Value), "\x00")
+		}
+	}
+
+	if message.Header.Type == syscall.RTM_DELLINK {
+		if name == w.name || int(ifInfo.Index) == w.index {
+			w.index = 0
+		}
+		return false
+	}
+	if name != w.name {
+		// The interface was renamed.
+		if int(ifInfo.Index) == w.index {
+			w.index = 0
+		}
+		return false
+	}
+	if int(ifInfo.Index) == w.index {
+		return false
+	}
+	w.index = int(ifInfo.Index)
+	return true
+}
+
+// Close stops watching, a pending WaitCreated returns an error.
+func (w *LinkWatcher) Close() error {
+	return w.file.Close()
+}
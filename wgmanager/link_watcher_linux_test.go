@@ -0,0 +1,113 @@
+package wgmanager
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestLinkWatcher creates a dummy link in a new network namespace, which requires root privileges.
+func TestLinkWatcher(t *testing.T) {
+	if _, err := exec.LookPath("ip"); err != nil {
+		t.Skip("ip command not found")
+	}
+	// The thread is not unlocked, so it exits with the test instead of being reused in the new network namespace.
+	runtime.LockOSThread()
+	if err := syscall.Unshare(syscall.CLONE_NEWNET); err != nil {
+		t.Skipf("Error creating network namespace: %s", err)
+	}
+	ip := func(args ...string) error {
+		if output, err := exec.Command("ip", args...).CombinedOutput(); err != nil {
+			return fmt.Errorf("ip %v: %s", args, bytes.TrimSpace(output))
+		}
+		return nil
+	}
+	if err := ip("link", "add", "wgtest0", "type", "dummy"); err != nil {
+		t.Skipf("Error creating dummy link: %s", err)
+	}
+
+	watcher, err := NewLinkWatcher("wgtest0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	created := make(chan error)
+	go func() {
+		for {
+			err := watcher.WaitCreated()
+			created <- err
+			if err != nil {
+				return
+			}
+		}
+	}()
+	expectCreated := func(exp bool, timeout time.Duration) {
+		select {
+		case err := <-created:
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !exp {
+				t.Fatal("Link creation reported while the link was not created")
+			}
+		case <-time.After(timeout):
+			if exp {
+				t.Fatal("Link creation not reported")
+			}
+		}
+	}
+
+	// Changes of the existing link and other links are not reported.
+	for _, args := range [][]string{
+		{"link", "set", "wgtest0", "up"},
+		{"link", "add", "other0", "type", "dummy"},
+	} {
+		if err := ip(args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectCreated(false, 200*time.Millisecond)
+
+	for _, args := range [][]string{
+		{"link", "del", "wgtest0"},
+		{"link", "add", "wgtest0", "type", "dummy"},
+	} {
+		if err := ip(args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectCreated(true, 5*time.Second)
+
+	if err := watcher.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-created:
+		if err == nil {
+			t.Error("WaitCreated did not return an error after closing")
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("WaitCreated did not return after closing")
+	}
+}
+
+func TestLinkWatcherResync(t *testing.T) {
+	watcher := &LinkWatcher{name: "lo"}
+	if !watcher.resync() {
+		t.Error("Existing link with a different index not reported as created")
+	}
+	if watcher.index == 0 {
+		t.Error("Index of the link not saved")
+	}
+	if watcher.resync() {
+		t.Error("Link with an unchanged index reported as created")
+	}
+
+	watcher = &LinkWatcher{name: "wgtest0", index: 1}
+	if watcher.resync() || watcher.index != 0 {
+		t.Errorf("Missing link reported as created or has index %d", watcher.index)
+	}
+}
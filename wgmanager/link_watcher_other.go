@@ -0,0 +1,21 @@
+//go:build !linux
+// +build !linux
+
+package wgmanager
+
+import "errors"
+
+// LinkWatcher is only supported on Linux.
+type LinkWatcher struct{}
+
+func NewLinkWatcher(name string) (*LinkWatcher, error) {
+	return nil, errors.New("watching link events is only supported on Linux")
+}
+
+func (w *LinkWatcher) WaitCreated() error {
+	return errors.New("watching link events is only supported on Linux")
+}
+
+func (w *LinkWatcher) Close() error {
+	return nil
+}
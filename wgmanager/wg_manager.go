@@ -2,6 +2,7 @@ package wgmanager
 
 import (
 	"fmt"
+	"net"
 	"time"
 
 	"golang.zx2c4.com/wireguard/wgctrl"
@@ -37,16 +38,33 @@ func (wgm WGManager) GeneratePrivateKey() (PrivateKey, error) {
 	return PrivateKey{privateKey}, err
 }
 
+func (wgm WGManager) GeneratePresharedKey() (PresharedKey, error) {
+	presharedKey, err := wgtypes.GenerateKey()
+	return PresharedKey{presharedKey}, err
+}
+
+// toPeerConfig converts a peer to the configuration of a peer in WireGuard. The preshared key and keepalive interval
+// are always set, so they are removed when a peer no longer uses them.
+func toPeerConfig(peer Peer) wgtypes.PeerConfig {
+	presharedKey := wgtypes.Key{}
+	if peer.PresharedKey != nil {
+		presharedKey = peer.PresharedKey.Key
+	}
+	persistentKeepalive := peer.PersistentKeepalive
+	return wgtypes.PeerConfig{
+		PublicKey:                   peer.PublicKey.Key,
+		PresharedKey:                &presharedKey,
+		PersistentKeepaliveInterval: &persistentKeepalive,
+		ReplaceAllowedIPs:           true,
+		AllowedIPs:                  peer.AllowedIPs,
+	}
+}
+
 func (wgm WGManager) ConfigureWG(peers []Peer) error {
 	wgPeers := []wgtypes.PeerConfig{}
 
 	for _, peer := range peers {
-		wgPeer := wgtypes.PeerConfig{
-			PublicKey:         peer.PublicKey.Key,
-			ReplaceAllowedIPs: true,
-			AllowedIPs:        peer.AllowedIPs,
-		}
-		wgPeers = append(wgPeers, wgPeer)
+		wgPeers = append(wgPeers, toPeerConfig(peer))
 	}
 
 	cfg := wgtypes.Config{
@@ -64,13 +82,7 @@ func (wgm WGManager) AddPeers(peers []Peer) error {
 	wgPeers := []wgtypes.PeerConfig{}
 
 	for _, peer := range peers {
-		wgPeers = append(wgPeers, wgtypes.PeerConfig{
-			Remove:            false,
-			UpdateOnly:        false,
-			PublicKey:         peer.PublicKey.Key,
-			ReplaceAllowedIPs: true,
-			AllowedIPs:        peer.AllowedIPs,
-		})
+		wgPeers = append(wgPeers, toPeerConfig(peer))
 	}
 
 	cfg := wgtypes.Config{
@@ -105,31 +117,62 @@ func (wgm WGManager) RemovePeers(publicKeys []PublicKey) error {
 	return nil
 }
 
-// GetConnections lists a config as connected when a handshake has been
-// performed with the client in the last 3 minutes. If a WireGuard client
-// did not perform a handshake in the last 3 minutes, all packets will be
-// dropped by WireGuard until the client performs a new handshake.
-func (wgm WGManager) GetConnections() ([]wgtypes.Peer, error) {
+// GetPeers returns all peers of the WireGuard interface.
+func (wgm WGManager) GetPeers() ([]wgtypes.Peer, error) {
 	wgDevice, err := wgm.client.Device(wgm.WGInterface)
 	if wgDevice == nil || err != nil {
 		return nil, err
 	}
+	return wgDevice.Peers, nil
+}
 
-	peers := []wgtypes.Peer{}
+// nolint
+// Taken from https://git.kernel.org/pub/scm/linux/kernel/git/zx2c4/wireguard-linux.git/tree/drivers/net/wireguard/messages.h?id=805c6d3c19210c90c109107d189744e960eae025#n46
+const RejectAfterTime = 180 * time.Second
 
-	// nolint
-	// Taken from https://git.kernel.org/pub/scm/linux/kernel/git/zx2c4/wireguard-linux.git/tree/drivers/net/wireguard/messages.h?id=805c6d3c19210c90c109107d189744e960eae025#n46
-	const REJECT_AFTER_TIME = 180 * time.Second
+// IsConnected returns true when a handshake has been performed with the peer in the last 3 minutes. If a WireGuard
+// client did not perform a handshake in the last 3 minutes, all packets will be dropped by WireGuard until the client
+// performs a new handshake.
+func IsConnected(peer wgtypes.Peer, now time.Time) bool {
+	return now.Sub(peer.LastHandshakeTime) < RejectAfterTime
+}
 
-	for _, p := range wgDevice.Peers {
-		now := time.Now()
-		if now.Sub(p.LastHandshakeTime) < REJECT_AFTER_TIME {
+// GetConnections lists the peers which are connected according to IsConnected.
+func (wgm WGManager) GetConnections() ([]wgtypes.Peer, error) {
+	wgPeers, err := wgm.GetPeers()
+	if err != nil {
+		return nil, err
+	}
+
+	peers := []wgtypes.Peer{}
+	now := time.Now()
+	for _, p := range wgPeers {
+		if IsConnected(p, now) {
 			peers = append(peers, p)
 		}
 	}
 	return peers, nil
 }
 
+// GetInterfaceAddresses returns the IP addresses set on the WireGuard interface.
+func (wgm WGManager) GetInterfaceAddresses() ([]net.IPNet, error) {
+	wgInterface, err := net.InterfaceByName(wgm.WGInterface)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := wgInterface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	var addresses []net.IPNet
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok {
+			addresses = append(addresses, *ipNet)
+		}
+	}
+	return addresses, nil
+}
+
 func (wgm WGManager) Close() error {
 	return wgm.client.Close()
 }